@@ -0,0 +1,71 @@
+package grafana_json_server
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// An AnnotationHandler responds to an annotation request from the JSON API datasource.
+type AnnotationHandler interface {
+	Annotations(ctx context.Context, request AnnotationRequest) ([]Annotation, error)
+}
+
+// The AnnotationHandlerFunc type is an adapter to allow the use of an ordinary function as AnnotationHandler.
+// If f is a function with the appropriate signature, then AnnotationHandlerFunc(f) is an AnnotationHandler that calls f.
+type AnnotationHandlerFunc func(ctx context.Context, request AnnotationRequest) ([]Annotation, error)
+
+// Annotations calls f(ctx, request)
+func (f AnnotationHandlerFunc) Annotations(ctx context.Context, request AnnotationRequest) ([]Annotation, error) {
+	return f(ctx, request)
+}
+
+// AnnotationRequest is the request sent to the AnnotationHandler.
+type AnnotationRequest struct {
+	Range      Range           `json:"range"`
+	RangeRaw   RawRange        `json:"rangeRaw"`
+	Annotation AnnotationQuery `json:"annotation"`
+	Variables  json.RawMessage `json:"variables"`
+}
+
+// AnnotationQuery is the annotation definition, as configured in the dashboard. Query holds the query text.
+type AnnotationQuery struct {
+	Name       string          `json:"name"`
+	Datasource json.RawMessage `json:"datasource"`
+	Enable     bool            `json:"enable"`
+	IconColor  string          `json:"iconColor"`
+	Query      string          `json:"query"`
+}
+
+// Annotation is one annotation returned by the AnnotationHandler. If TimeEnd is set, the annotation covers a region,
+// rather than a single point in time.
+type Annotation struct {
+	Time    time.Time
+	TimeEnd time.Time
+	Title   string
+	Text    string
+	Tags    []string
+}
+
+// MarshalJSON converts an Annotation to JSON.
+func (a Annotation) MarshalJSON() ([]byte, error) {
+	type annotation struct {
+		Time     int64    `json:"time"`
+		TimeEnd  int64    `json:"timeEnd,omitempty"`
+		IsRegion bool     `json:"isRegion,omitempty"`
+		Title    string   `json:"title,omitempty"`
+		Text     string   `json:"text"`
+		Tags     []string `json:"tags,omitempty"`
+	}
+	output := annotation{
+		Time:  a.Time.UnixMilli(),
+		Title: a.Title,
+		Text:  a.Text,
+		Tags:  a.Tags,
+	}
+	if !a.TimeEnd.IsZero() {
+		output.TimeEnd = a.TimeEnd.UnixMilli()
+		output.IsRegion = true
+	}
+	return json.Marshal(output)
+}
@@ -0,0 +1,267 @@
+package grafana_json_server
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// QueryCacheOptions configures a QueryCache.
+type QueryCacheOptions struct {
+	// TTL is how long a response remains in the cache.
+	TTL time.Duration
+	// MaxSize is the maximum size of all cached responses, in bytes. The size of a response is estimated from the number
+	// and type of its values. When the cache is full, the least recently used responses are removed. If MaxSize is zero,
+	// the cache size is not limited: expired responses are still removed as new responses are added.
+	MaxSize int
+	// Namespace and Subsystem are prepended to the name of the cache's Prometheus metrics, if not blank.
+	Namespace string
+	Subsystem string
+	// Application is added to the cache's Prometheus metrics as a label "application".
+	Application string
+}
+
+// A QueryCache caches the responses of one or more Handlers. Use its Handler method to add caching to a Handler:
+//
+//	cache := grafanaJSONServer.NewQueryCache(grafanaJSONServer.QueryCacheOptions{TTL: time.Minute})
+//	s := grafanaJSONServer.NewServer(
+//		grafanaJSONServer.WithHandler("metric1", cache.Handler(handler)),
+//	)
+//
+// Responses are cached per target, payload, scoped variables and time range. The time range is aligned to
+// the request's IntervalMs, so requests whose time range falls in the same interval share the same response.
+//
+// QueryCache implements prometheus.Collector, counting cache hits and misses per target. The caller must register
+// the cache with the Prometheus registry.
+type QueryCache struct {
+	cache  *lruCache[QueryResponse]
+	hits   *prometheus.CounterVec
+	misses *prometheus.CounterVec
+}
+
+var _ prometheus.Collector = &QueryCache{}
+
+// NewQueryCache returns a new QueryCache, configured as per the provided QueryCacheOptions.
+func NewQueryCache(options QueryCacheOptions) *QueryCache {
+	return &QueryCache{
+		cache: newLRUCache[QueryResponse](options.TTL, options.MaxSize),
+		hits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   options.Namespace,
+			Subsystem:   options.Subsystem,
+			Name:        "json_query_cache_hit_count",
+			Help:        "Grafana JSON Data server count of query responses served from cache",
+			ConstLabels: prometheus.Labels{"application": options.Application},
+		}, []string{"target"}),
+		misses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   options.Namespace,
+			Subsystem:   options.Subsystem,
+			Name:        "json_query_cache_miss_count",
+			Help:        "Grafana JSON Data server count of query responses not found in cache",
+			ConstLabels: prometheus.Labels{"application": options.Application},
+		}, []string{"target"}),
+	}
+}
+
+// Handler returns a Handler that serves responses from the cache and calls handler for any responses not found in the cache.
+// Failed queries are not cached.
+func (c *QueryCache) Handler(handler Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, target string, req QueryRequest) (QueryResponse, error) {
+		key, err := queryCacheKey(target, req)
+		if err != nil {
+			return handler.Query(ctx, target, req)
+		}
+		if resp, ok := c.cache.get(key); ok {
+			c.hits.WithLabelValues(target).Add(1)
+			return resp, nil
+		}
+		c.misses.WithLabelValues(target).Add(1)
+		resp, err := handler.Query(ctx, target, req)
+		if err == nil {
+			if size, ok := queryResponseSize(resp); ok {
+				c.cache.add(key, resp, size)
+			}
+		}
+		return resp, err
+	})
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *QueryCache) Describe(descs chan<- *prometheus.Desc) {
+	c.hits.Describe(descs)
+	c.misses.Describe(descs)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *QueryCache) Collect(metrics chan<- prometheus.Metric) {
+	c.hits.Collect(metrics)
+	c.misses.Collect(metrics)
+}
+
+// queryResponseSize estimates the memory size of a query response from the number and type of its values.
+// For custom QueryResponse types, queryResponseSize uses the size of the JSON encoding. Responses that can't be encoded
+// would fail the query anyway, so queryResponseSize returns false, and they are not cached.
+func queryResponseSize(resp QueryResponse) (int, bool) {
+	switch r := resp.(type) {
+	case TimeSeriesResponse:
+		return len(r.Target) + len(r.DataPoints)*dataPointSize, true
+	case MultiTimeSeriesResponse:
+		var size int
+		for _, timeSeries := range r {
+			size += len(timeSeries.Target) + len(timeSeries.DataPoints)*dataPointSize
+		}
+		return size, true
+	case TableResponse:
+		var size int
+		for _, column := range r.Columns {
+			size += len(column.Text) + valuesSize(column.Data)
+		}
+		return size, true
+	case DataFrameResponse:
+		size := len(r.Name) + len(r.RefID)
+		for _, field := range r.Fields {
+			size += len(field.Name) + valuesSize(field.Values)
+		}
+		return size, true
+	default:
+		body, err := json.Marshal(resp)
+		return len(body), err == nil
+	}
+}
+
+// valuesSize estimates the memory size of a slice of values, as found in a table column or a data frame field.
+// For pointer values, the size of the value pointed to is included. For strings, the size of their content is included.
+func valuesSize(values any) int {
+	v := reflect.ValueOf(values)
+	if v.Kind() != reflect.Slice {
+		return 0
+	}
+	elemType := v.Type().Elem()
+	size := v.Len() * int(elemType.Size())
+	if elemType.Kind() == reflect.Pointer {
+		size += v.Len() * int(elemType.Elem().Size())
+	}
+	switch values := values.(type) {
+	case StringColumn:
+		for _, value := range values {
+			size += len(value)
+		}
+	case []string:
+		for _, value := range values {
+			size += len(value)
+		}
+	case NullableStringColumn:
+		for _, value := range values {
+			if value != nil {
+				size += len(*value)
+			}
+		}
+	}
+	return size
+}
+
+func queryCacheKey(target string, req QueryRequest) (string, error) {
+	payload, _ := req.findPayload(target)
+	from, to := req.Range.From, req.Range.To
+	if interval := time.Duration(req.IntervalMs) * time.Millisecond; interval > 0 {
+		from, to = from.Truncate(interval), to.Truncate(interval)
+	}
+	key, err := json.Marshal(struct {
+		Target        string
+		Payload       json.RawMessage
+		ScopedVars    json.RawMessage
+		AdhocFilters  []any
+		From          time.Time
+		To            time.Time
+		IntervalMs    int
+		MaxDataPoints int
+	}{
+		Target:        target,
+		Payload:       payload,
+		ScopedVars:    req.ScopedVars,
+		AdhocFilters:  req.AdhocFilters,
+		From:          from,
+		To:            to,
+		IntervalMs:    req.IntervalMs,
+		MaxDataPoints: req.MaxDataPoints,
+	})
+	return string(key), err
+}
+
+// lruCache is a size-bound cache, where entries expire after a fixed TTL. When the cache is full, the least recently used
+// entries are removed.
+//
+// Expired entries are removed when they are read, or when new entries are added: add removes any expired entries at
+// the back of the list. An expired entry that was read recently, and so is further up the list, is removed once the
+// entries behind it have expired too, i.e. at most one TTL later. This keeps the cache from growing without bound,
+// even if its size is not limited.
+type lruCache[V any] struct {
+	ttl     time.Duration
+	maxSize int
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	size    int
+}
+
+type lruCacheEntry[V any] struct {
+	key    string
+	value  V
+	size   int
+	expiry time.Time
+}
+
+func newLRUCache[V any](ttl time.Duration, maxSize int) *lruCache[V] {
+	return &lruCache[V]{
+		ttl:     ttl,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *lruCache[V]) get(key string) (V, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var value V
+	element, ok := c.entries[key]
+	if !ok {
+		return value, false
+	}
+	entry := element.Value.(*lruCacheEntry[V])
+	if time.Now().After(entry.expiry) {
+		c.remove(element)
+		return value, false
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+func (c *lruCache[V]) add(key string, value V, size int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.maxSize > 0 && size > c.maxSize {
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	now := time.Now()
+	for back := c.order.Back(); back != nil && now.After(back.Value.(*lruCacheEntry[V]).expiry); back = c.order.Back() {
+		c.remove(back)
+	}
+	c.entries[key] = c.order.PushFront(&lruCacheEntry[V]{key: key, value: value, size: size, expiry: now.Add(c.ttl)})
+	c.size += size
+	for c.maxSize > 0 && c.size > c.maxSize {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *lruCache[V]) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*lruCacheEntry[V])
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
@@ -0,0 +1,48 @@
+package grafana_json_server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLRUCache_RemovesExpiredEntries(t *testing.T) {
+	c := newLRUCache[int](50*time.Millisecond, 0)
+	c.add("foo", 1, 10)
+	c.add("bar", 2, 10)
+
+	time.Sleep(100 * time.Millisecond)
+	c.add("snafu", 3, 10)
+
+	assert.Len(t, c.entries, 1)
+	assert.Equal(t, 1, c.order.Len())
+	assert.Equal(t, 10, c.size)
+}
+
+func TestQueryResponseSize(t *testing.T) {
+	value := "foo"
+	tests := []struct {
+		name string
+		resp QueryResponse
+		want int
+	}{
+		{name: "time series", resp: TimeSeriesResponse{Target: "foo", DataPoints: make([]DataPoint, 10)}, want: 3 + 10*dataPointSize},
+		{name: "table", resp: TableResponse{Columns: []Column{
+			{Text: "time", Data: TimeColumn{time.Time{}}},
+			{Text: "value", Data: NumberColumn{1, 2}},
+			{Text: "label", Data: StringColumn{"foo", "bar"}},
+			{Text: "nullable", Data: NullableStringColumn{&value, nil}},
+		}}, want: (4 + 24) + // header and one time.Time
+			(5 + 2*8) + // header and two float64s
+			(5 + 2*16 + 6) + // header, two string headers and their content
+			(8 + 2*8 + 2*16 + 3)}, // header, two pointers, two string headers and the content of the non-nil string
+		{name: "data frame", resp: DataFrameResponse{Name: "foo", Fields: []Field{{Name: "value", Values: []float64{1, 2}}}}, want: 3 + 5 + 2*8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, ok := queryResponseSize(tt.resp)
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, size)
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package grafana_json_server_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	gjson "github.com/clambin/grafana-json-server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryCache_Handler(t *testing.T) {
+	var calls int
+	handler := gjson.HandlerFunc(func(_ context.Context, target string, req gjson.QueryRequest) (gjson.QueryResponse, error) {
+		calls++
+		if target == "fail" {
+			return nil, errors.New("failed")
+		}
+		return gjson.TimeSeriesResponse{Target: target, DataPoints: []gjson.DataPoint{{Timestamp: req.Range.From, Value: float64(calls)}}}, nil
+	})
+
+	cache := gjson.NewQueryCache(gjson.QueryCacheOptions{TTL: time.Hour, Application: "test"})
+	h := cache.Handler(handler)
+
+	from := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	makeRequest := func(target string, payload string, offset time.Duration) gjson.QueryRequest {
+		return gjson.QueryRequest{
+			IntervalMs: 60_000,
+			Range:      gjson.Range{From: from.Add(offset), To: from.Add(time.Hour + offset)},
+			Targets:    []gjson.QueryRequestTarget{{Target: target, Payload: json.RawMessage(payload)}},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		target    string
+		payload   string
+		offset    time.Duration
+		wantErr   assert.ErrorAssertionFunc
+		wantValue float64
+	}{
+		{name: "miss", target: "foo", payload: `{"a":"b"}`, wantErr: assert.NoError, wantValue: 1},
+		{name: "hit", target: "foo", payload: `{"a":"b"}`, wantErr: assert.NoError, wantValue: 1},
+		{name: "hit - same interval", target: "foo", payload: `{"a":"b"}`, offset: 30 * time.Second, wantErr: assert.NoError, wantValue: 1},
+		{name: "miss - next interval", target: "foo", payload: `{"a":"b"}`, offset: time.Minute, wantErr: assert.NoError, wantValue: 2},
+		{name: "miss - different payload", target: "foo", payload: `{"a":"c"}`, wantErr: assert.NoError, wantValue: 3},
+		{name: "miss - different target", target: "bar", payload: `{"a":"b"}`, wantErr: assert.NoError, wantValue: 4},
+		{name: "error", target: "fail", payload: `{"a":"b"}`, wantErr: assert.Error},
+		{name: "error not cached", target: "fail", payload: `{"a":"b"}`, wantErr: assert.Error},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := h.Query(context.Background(), tt.target, makeRequest(tt.target, tt.payload, tt.offset))
+			tt.wantErr(t, err)
+			if err == nil {
+				require.IsType(t, gjson.TimeSeriesResponse{}, resp)
+				assert.Equal(t, tt.wantValue, resp.(gjson.TimeSeriesResponse).DataPoints[0].Value)
+			}
+		})
+	}
+
+	assert.Equal(t, 6, calls)
+	assert.NoError(t, testutil.CollectAndCompare(cache, strings.NewReader(`
+# HELP json_query_cache_hit_count Grafana JSON Data server count of query responses served from cache
+# TYPE json_query_cache_hit_count counter
+json_query_cache_hit_count{application="test",target="foo"} 2
+# HELP json_query_cache_miss_count Grafana JSON Data server count of query responses not found in cache
+# TYPE json_query_cache_miss_count counter
+json_query_cache_miss_count{application="test",target="bar"} 1
+json_query_cache_miss_count{application="test",target="fail"} 2
+json_query_cache_miss_count{application="test",target="foo"} 3
+`)))
+}
+
+func TestQueryCache_Expiry(t *testing.T) {
+	var calls int
+	handler := gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+		calls++
+		return gjson.TimeSeriesResponse{Target: target}, nil
+	})
+
+	h := gjson.NewQueryCache(gjson.QueryCacheOptions{TTL: 50 * time.Millisecond}).Handler(handler)
+	req := gjson.QueryRequest{Targets: []gjson.QueryRequestTarget{{Target: "foo"}}}
+
+	for range 2 {
+		_, err := h.Query(context.Background(), "foo", req)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, calls)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err := h.Query(context.Background(), "foo", req)
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestQueryCache_MaxSize(t *testing.T) {
+	var calls int
+	handler := gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+		calls++
+		return gjson.TimeSeriesResponse{Target: target, DataPoints: []gjson.DataPoint{{Timestamp: time.Now(), Value: 1}}}, nil
+	})
+
+	// each response is 36 bytes: a 4-byte target and one 32-byte data point
+	h := gjson.NewQueryCache(gjson.QueryCacheOptions{TTL: time.Hour, MaxSize: 80}).Handler(handler)
+	query := func(target string) {
+		_, err := h.Query(context.Background(), target, gjson.QueryRequest{Targets: []gjson.QueryRequestTarget{{Target: target}}})
+		require.NoError(t, err)
+	}
+
+	query("foo1")
+	query("foo2")
+	query("foo1")
+	assert.Equal(t, 2, calls)
+
+	// adding foo3 evicts the least recently used response, i.e. foo2
+	query("foo3")
+	query("foo1")
+	assert.Equal(t, 3, calls)
+	query("foo2")
+	assert.Equal(t, 4, calls)
+}
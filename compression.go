@@ -0,0 +1,192 @@
+package grafana_json_server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A ContentEncoder compresses HTTP responses with a content encoding (e.g. gzip). See WithCompression.
+//
+// The server only offers gzip (see GzipEncoder). Other encodings, like zstd, can be added by implementing ContentEncoder.
+type ContentEncoder interface {
+	// Encoding returns the name of the content encoding, as used in the Accept-Encoding and Content-Encoding headers.
+	Encoding() string
+	// NewWriter returns a WriteCloser that compresses all data written to it, and writes it to w.
+	// Close is called once the full response has been written.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// GzipEncoder returns a ContentEncoder that compresses responses with gzip, using the provided compression level
+// (see compress/gzip).
+func GzipEncoder(level int) ContentEncoder {
+	return &gzipEncoder{level: level}
+}
+
+type gzipEncoder struct {
+	level int
+	pool  sync.Pool
+}
+
+func (e *gzipEncoder) Encoding() string {
+	return "gzip"
+}
+
+func (e *gzipEncoder) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if zw, ok := e.pool.Get().(*gzip.Writer); ok {
+		zw.Reset(w)
+		return &pooledGzipWriter{Writer: zw, pool: &e.pool}, nil
+	}
+	zw, err := gzip.NewWriterLevel(w, e.level)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledGzipWriter{Writer: zw, pool: &e.pool}, nil
+}
+
+// pooledGzipWriter returns the gzip.Writer to the pool when it's closed.
+type pooledGzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (w *pooledGzipWriter) Close() error {
+	err := w.Writer.Close()
+	w.pool.Put(w.Writer)
+	return err
+}
+
+// compression holds the server's configuration for compressing responses.
+type compression struct {
+	encoders []ContentEncoder
+	minSize  int
+}
+
+// compress returns a http.HandlerFunc that compresses the response of the handler, if the client accepts one of the
+// configured content encodings and the response is at least minSize bytes.
+func (c compression) compress(handler http.HandlerFunc) http.HandlerFunc {
+	if len(c.encoders) == 0 {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoder := negotiateEncoding(r.Header.Values("Accept-Encoding"), c.encoders)
+		if encoder == nil {
+			handler(w, r)
+			return
+		}
+		cw := compressResponseWriter{ResponseWriter: w, encoder: encoder, minSize: c.minSize, status: http.StatusOK}
+		handler(&cw, r)
+		cw.close()
+	}
+}
+
+// negotiateEncoding returns the encoder with the highest quality in the Accept-Encoding headers. If several encoders
+// have the same quality, the first one is selected. If none of the encoders is accepted, negotiateEncoding returns nil.
+func negotiateEncoding(acceptEncoding []string, encoders []ContentEncoder) ContentEncoder {
+	qualities := make(map[string]float64)
+	for _, header := range acceptEncoding {
+		for _, entry := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(entry, ";")
+			quality := 1.0
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				var err error
+				if quality, err = strconv.ParseFloat(q, 64); err != nil {
+					continue
+				}
+			}
+			qualities[strings.ToLower(strings.TrimSpace(name))] = quality
+		}
+	}
+
+	var selected ContentEncoder
+	var selectedQuality float64
+	for _, encoder := range encoders {
+		quality, ok := qualities[encoder.Encoding()]
+		if !ok {
+			quality = qualities["*"]
+		}
+		if quality > selectedQuality {
+			selected, selectedQuality = encoder, quality
+		}
+	}
+	return selected
+}
+
+// compressResponseWriter buffers the response until it reaches minSize bytes. It then compresses the remainder of
+// the response. Smaller responses are sent uncompressed.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoder     ContentEncoder
+	minSize     int
+	status      int
+	buf         []byte
+	writer      io.WriteCloser
+	wroteHeader bool
+	err         error
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader && len(w.buf) == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.writer != nil {
+		return w.writer.Write(b)
+	}
+	if w.wroteHeader {
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.minSize {
+		w.startCompression()
+	}
+	return len(b), w.err
+}
+
+func (w *compressResponseWriter) startCompression() {
+	if w.Header().Get("Content-Encoding") != "" {
+		// response is already encoded
+		w.flushUncompressed()
+		return
+	}
+	writer, err := w.encoder.NewWriter(w.ResponseWriter)
+	if err != nil {
+		w.flushUncompressed()
+		return
+	}
+	w.writer = writer
+	w.Header().Set("Content-Encoding", w.encoder.Encoding())
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.wroteHeader = true
+	_, w.err = w.writer.Write(w.buf)
+	w.buf = nil
+}
+
+func (w *compressResponseWriter) flushUncompressed() {
+	w.ResponseWriter.WriteHeader(w.status)
+	w.wroteHeader = true
+	if len(w.buf) > 0 {
+		_, w.err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+}
+
+func (w *compressResponseWriter) close() {
+	if w.writer != nil {
+		_ = w.writer.Close()
+		return
+	}
+	if !w.wroteHeader {
+		w.flushUncompressed()
+	}
+}
@@ -0,0 +1,141 @@
+package grafana_json_server_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gjson "github.com/clambin/grafana-json-server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeEncoder string
+
+func (e fakeEncoder) Encoding() string {
+	return string(e)
+}
+
+func (e fakeEncoder) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestWithCompression_Negotiation(t *testing.T) {
+	s := gjson.NewServer(
+		gjson.WithCompression(0, fakeEncoder("zstd"), gjson.GzipEncoder(gzip.DefaultCompression)),
+	)
+
+	tests := []struct {
+		name           string
+		acceptEncoding []string
+		want           string
+	}{
+		{name: "none", want: ""},
+		{name: "gzip", acceptEncoding: []string{"gzip"}, want: "gzip"},
+		{name: "server preference", acceptEncoding: []string{"gzip, deflate, br, zstd"}, want: "zstd"},
+		{name: "client preference", acceptEncoding: []string{"zstd;q=0.5, gzip;q=0.8"}, want: "gzip"},
+		{name: "multiple headers", acceptEncoding: []string{"br", "GZIP"}, want: "gzip"},
+		{name: "wildcard", acceptEncoding: []string{"*"}, want: "zstd"},
+		{name: "excluded", acceptEncoding: []string{"zstd;q=0, *"}, want: "gzip"},
+		{name: "not accepted", acceptEncoding: []string{"gzip;q=0"}, want: ""},
+		{name: "unsupported", acceptEncoding: []string{"br, identity"}, want: ""},
+		{name: "invalid quality", acceptEncoding: []string{"gzip;q=high"}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "/metrics", bytes.NewBufferString(`{}`))
+			req.Header["Accept-Encoding"] = tt.acceptEncoding
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.want, w.Header().Get("Content-Encoding"))
+		})
+	}
+}
+
+func TestServer_WithCompression(t *testing.T) {
+	s := gjson.NewServer(
+		gjson.WithCompression(128),
+		gjson.WithHandler("large", gjson.HandlerFunc(func(_ context.Context, _ string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			timestamps := make(gjson.TimeColumn, 100)
+			for i := range timestamps {
+				timestamps[i] = time.Date(2024, time.March, 8, 0, i, 0, 0, time.UTC)
+			}
+			return gjson.TableResponse{Columns: []gjson.Column{{Text: "time", Data: timestamps}}}, nil
+		})),
+		gjson.WithHandler("small", gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			return gjson.TimeSeriesResponse{Target: target}, nil
+		})),
+	)
+
+	tests := []struct {
+		name           string
+		target         string
+		acceptEncoding string
+		wantCompressed bool
+	}{
+		{name: "compressed", target: "large", acceptEncoding: "gzip", wantCompressed: true},
+		{name: "not accepted", target: "large"},
+		{name: "below threshold", target: "small", acceptEncoding: "gzip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{ "targets": [ { "target": "` + tt.target + `" } ] }`
+			req, _ := http.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(body))
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+
+			response := w.Body.Bytes()
+			if tt.wantCompressed {
+				assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+				r, err := gzip.NewReader(w.Body)
+				require.NoError(t, err)
+				response, err = io.ReadAll(r)
+				require.NoError(t, err)
+			} else {
+				assert.Empty(t, w.Header().Get("Content-Encoding"))
+			}
+
+			want := queryServer(t, s, body)
+			assert.Equal(t, string(want), string(response))
+		})
+	}
+}
+
+func TestServer_WithCompression_Error(t *testing.T) {
+	s := gjson.NewServer(gjson.WithCompression(0))
+
+	req, _ := http.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`not json`))
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	r, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "invalid request")
+}
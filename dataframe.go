@@ -0,0 +1,136 @@
+package grafana_json_server
+
+import (
+	"errors"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+)
+
+var _ QueryResponse = DataFrameResponse{}
+
+// DataFrameResponse is returned by a query as a Grafana data frame. Unlike a TableResponse, each field can have
+// its own labels and configuration (e.g. units, display names and thresholds), which Grafana applies without any
+// dashboard overrides.
+//
+// RefID should match the RefID of the query's target. If RefID is blank, the server sets it.
+type DataFrameResponse struct {
+	Name   string
+	RefID  string
+	Fields []Field
+}
+
+// Field is one field of a DataFrameResponse. Values holds the slice of values and should be one of the column types
+// supported by TableResponse (see Column). All fields of a DataFrameResponse should have the same number of values.
+type Field struct {
+	Name   string
+	Labels map[string]string
+	Config *FieldConfig
+	Values any
+}
+
+// FieldConfig holds the display configuration of a Field. See the Grafana documentation for the possible values.
+type FieldConfig struct {
+	DisplayName       string         `json:"displayName,omitempty"`
+	DisplayNameFromDS string         `json:"displayNameFromDS,omitempty"`
+	Unit              string         `json:"unit,omitempty"`
+	Decimals          *int           `json:"decimals,omitempty"`
+	Min               *float64       `json:"min,omitempty"`
+	Max               *float64       `json:"max,omitempty"`
+	NoValue           string         `json:"noValue,omitempty"`
+	Thresholds        *Thresholds    `json:"thresholds,omitempty"`
+	Custom            map[string]any `json:"custom,omitempty"`
+}
+
+// ThresholdsMode determines how Grafana interprets the values of Thresholds.
+type ThresholdsMode string
+
+const (
+	ThresholdsModeAbsolute   ThresholdsMode = "absolute"
+	ThresholdsModePercentage ThresholdsMode = "percentage"
+)
+
+// Thresholds configures the thresholds of a Field. Steps should be sorted by value. The first step should have a nil Value,
+// which Grafana interprets as negative infinity.
+type Thresholds struct {
+	Mode  ThresholdsMode `json:"mode"`
+	Steps []Threshold    `json:"steps"`
+}
+
+// Threshold is one step of a Field's Thresholds.
+type Threshold struct {
+	Value *float64 `json:"value"`
+	Color string   `json:"color"`
+}
+
+type dataFrame struct {
+	Name   string           `json:"name,omitempty"`
+	RefID  string           `json:"refId,omitempty"`
+	Fields []dataFrameField `json:"fields"`
+}
+
+type dataFrameField struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Config *FieldConfig      `json:"config,omitempty"`
+	Values any               `json:"values"`
+}
+
+// MarshalJSON converts a DataFrameResponse to JSON.
+func (d DataFrameResponse) MarshalJSON() ([]byte, error) {
+	fields, err := d.buildFields()
+	if err != nil {
+		return nil, err
+	}
+	return jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(dataFrame{
+		Name:   d.Name,
+		RefID:  d.RefID,
+		Fields: fields,
+	})
+}
+
+func (d DataFrameResponse) buildFields() ([]dataFrameField, error) {
+	fields := make([]dataFrameField, len(d.Fields))
+	var rowCount int
+	for i, field := range d.Fields {
+		fieldType, count, ok := columnType(field.Values)
+		if !ok {
+			return nil, fmt.Errorf("error building data frame output: field %q has unsupported type %T", field.Name, field.Values)
+		}
+		if i == 0 {
+			rowCount = count
+		}
+		if count != rowCount {
+			return nil, errors.New("error building data frame output: all fields must have the same number of values")
+		}
+
+		// data frames expect timestamps as epoch milliseconds
+		values := field.Values
+		switch timestamps := values.(type) {
+		case TimeColumn:
+			epochs := make([]int64, len(timestamps))
+			for j, timestamp := range timestamps {
+				epochs[j] = timestamp.UnixMilli()
+			}
+			values = epochs
+		case NullableTimeColumn:
+			epochs := make([]*int64, len(timestamps))
+			for j, timestamp := range timestamps {
+				if timestamp != nil {
+					epoch := timestamp.UnixMilli()
+					epochs[j] = &epoch
+				}
+			}
+			values = epochs
+		}
+
+		fields[i] = dataFrameField{
+			Name:   field.Name,
+			Type:   fieldType,
+			Labels: field.Labels,
+			Config: field.Config,
+			Values: values,
+		}
+	}
+	return fields, nil
+}
@@ -29,13 +29,14 @@ To provide more configuration options for the metric, use WithMetric instead:
 
 # Writing query functions
 
-The query function produces the data to be sent to Grafana. Queries can be of one of two types:
+The query function produces the data to be sent to Grafana. Queries can be of one of three types:
 
   - time series queries return values as a list of timestamp/value tuples.
   - table queries return data organized in columns and rows.  Each column needs to have the same number of rows
+  - data frame queries return data organized in fields, each with their own labels and configuration.
 
-Time series queries can therefore only return a single set of values.  If your query involves returning multiple sets of
-data, use table queries instead.
+A TimeSeriesResponse holds a single set of values.  If your query involves returning multiple sets of data,
+return a MultiTimeSeriesResponse, or use table queries instead.
 
 # Writing time series queries
 
@@ -52,6 +53,23 @@ A time series query returns a TimeSeriesResponse:
 		}, nil
 	}
 
+To return multiple time series for a single target, e.g. one per host selected in a multi-select payload option,
+return a MultiTimeSeriesResponse. Each time series is sent to Grafana as a separate series:
+
+	func Query(_ context.Context, target string, req grafanaJSONServer.QueryRequest) (grafanaJSONServer.QueryResponse, error) {
+		var payload struct {
+			Hosts []string
+		}
+		if err := req.GetPayload(target, &payload); err != nil {
+			return nil, err
+		}
+		resp := make(grafanaJSONServer.MultiTimeSeriesResponse, len(payload.Hosts))
+		for i, host := range payload.Hosts {
+			resp[i] = grafanaJSONServer.TimeSeriesResponse{Target: host, DataPoints: getDataPoints(host)}
+		}
+		return resp, nil
+	}
+
 # Writing table queries
 
 A table query returns a TableResponse:
@@ -71,6 +89,124 @@ A table query returns a TableResponse:
 
 Note that the table must be 'complete', i.e. each column should have the same number of entries.
 
+If the data is already held in a slice of structs, TableResponseFromSlice builds the table directly, with one column per
+exported field. Use a "grafana" tag to set the column's name:
+
+	type Row struct {
+		Timestamp time.Time `grafana:"Time"`
+		Label     string    `grafana:"Label"`
+		Value     *float64  `grafana:"Series A"`
+	}
+
+	resp, err := grafanaJSONServer.TableResponseFromSlice(rows)
+
+TimeSeriesResponse and TableResponse implement StreamingQueryResponse: the server writes their data points and rows
+directly to the HTTP response, without building the full JSON encoding in memory first.
+
+# Writing data frame queries
+
+A data frame query returns a DataFrameResponse. Unlike a table, each field can have its own labels and configuration,
+e.g. units, display names and thresholds:
+
+	func Query(_ context.Context, _ string, _ grafanaJSONServer.QueryRequest) (grafanaJSONServer.QueryResponse, error) {
+		return grafanaJSONServer.DataFrameResponse{
+			Fields: []grafanaJSONServer.Field{
+				{Name: "Time", Values: grafanaJSONServer.TimeColumn{
+					time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+					time.Date(2020, 1, 1, 0, 1, 0, 0, time.UTC)}},
+				{Name: "Usage", Labels: map[string]string{"host": "foo"}, Config: &grafanaJSONServer.FieldConfig{Unit: "percent"},
+					Values: grafanaJSONServer.NumberColumn{42, 43}},
+			},
+		}, nil
+	}
+
+# Downsampling
+
+Grafana sends the maximum number of data points a panel can show in the QueryRequest's MaxDataPoints. To reduce the
+number of data points of time series and time-indexed tables to that maximum, create the server with the WithDownsampling option:
+
+	s := grafanaJSONServer.NewServer(
+		grafanaJSONServer.WithDownsampling(grafanaJSONServer.DownsampleLTTB),
+		grafanaJSONServer.WithMetric(metric, query, nil, grafanaJSONServer.WithMetricDownsampling(grafanaJSONServer.DownsampleAverage)),
+	)
+
+Use WithMetricDownsampling to override the method for a single metric.
+
+# Middleware
+
+To add behaviour to the Handlers of all metrics, create the server with the WithQueryMiddleware option:
+
+	s := grafanaJSONServer.NewServer(
+		grafanaJSONServer.WithQueryMiddleware(
+			grafanaJSONServer.RequestIDMiddleware(),
+			grafanaJSONServer.LoggingMiddleware(slog.Default()),
+			grafanaJSONServer.RecoveryMiddleware(),
+		),
+		grafanaJSONServer.WithHandler("metric1", query),
+	)
+
+Middleware is applied in order, i.e. the first Middleware is called first.
+
+# Reporting query errors
+
+By default, if a query fails, the server logs the error and leaves the target out of the response. Grafana then shows "no data".
+To report the error to Grafana instead, create the server with the WithQueryErrorReporting option.
+
+To keep internal details out of the dashboard, the server only reports the message of a QueryError:
+
+	func Query(_ context.Context, _ string, _ grafanaJSONServer.QueryRequest) (grafanaJSONServer.QueryResponse, error) {
+		if err := backend.Ping(); err != nil {
+			return nil, &grafanaJSONServer.QueryError{Message: "backend unavailable", Err: err}
+		}
+		...
+	}
+
+Any other error is reported as "query failed".
+
+# Caching query responses
+
+If a Handler queries an expensive backend, use a QueryCache to cache its responses:
+
+	cache := grafanaJSONServer.NewQueryCache(grafanaJSONServer.QueryCacheOptions{TTL: time.Minute, MaxSize: 64 << 20})
+	s := grafanaJSONServer.NewServer(
+		grafanaJSONServer.WithHandler("metric1", cache.Handler(grafanaJSONServer.HandlerFunc(query))),
+	)
+
+Responses are cached per target, payload, scoped variables and time range.
+
+For time series that are refreshed frequently, a TimeSeriesCache only calls the Handler for the part of the time range
+that is not cached yet:
+
+	cache := grafanaJSONServer.NewTimeSeriesCache(grafanaJSONServer.TimeSeriesCacheOptions{TTL: time.Hour, Overlap: time.Minute})
+
+# Compressing responses
+
+To compress large responses, create the server with the WithCompression option. Responses smaller than the minimum
+size are sent uncompressed:
+
+	s := grafanaJSONServer.NewServer(
+		grafanaJSONServer.WithCompression(1024),
+	)
+
+By default, responses are compressed with gzip. Other encodings (e.g. zstd) can be offered by implementing ContentEncoder.
+
+# Prometheus metrics
+
+The server records Prometheus metrics for each query target (see NewDefaultPrometheusQueryMetrics) and for each request
+to any of its endpoints (see NewDefaultPrometheusRequestMetrics). The latter include the number, duration, errors and
+response size of requests, labelled by endpoint and target, and counters for requests that could not be decoded and for
+unknown targets. Only registered metric and variable names (or, for variables routed by a pattern, the pattern) are used
+as target, so clients can't create an unlimited number of time series. To expose the metrics, create them, pass them to
+the server and register them with Prometheus:
+
+	queryMetrics := grafanaJSONServer.NewDefaultPrometheusQueryMetrics("", "", "my-app")
+	requestMetrics := grafanaJSONServer.NewDefaultPrometheusRequestMetrics("", "", "my-app")
+	s := grafanaJSONServer.NewServer(
+		grafanaJSONServer.WithPrometheusQueryMetrics(queryMetrics),
+		grafanaJSONServer.WithPrometheusRequestMetrics(requestMetrics),
+	)
+	prometheus.MustRegister(queryMetrics, requestMetrics)
+
 # Metric Payload Options
 
 The JSON API Grafana Datasource allows each metric to have a number of user-selectable options. In the Grafana Edit panel,
@@ -107,6 +243,11 @@ When performing the query, the query function can check which options are select
 
 The payload Option field will contain all selected options, i.e. option1, option2.  If no options are selected, Option will be an empty slice.
 
+A panel may query the same metric more than once, with different payloads. The request's Target field holds the
+target being queried, so its payload can be read directly:
+
+	_ = req.Target.GetPayload(&payload)
+
 Note: the payload structure must match the metric's payload definition. Otherwise GetPayload returns an error.
 With the above metric definition, the following will fail:
 
@@ -117,6 +258,40 @@ With the above metric definition, the following will fail:
 
 Since Option is a multi-select option, a slice is expected.
 
+GetTypedPayload checks the payload against the metric's definition before unmarshalling it: unknown options, values that
+are not one of the option's Options and single values for multi-select options are all reported as a PayloadValidationError:
+
+	payload, err := grafanaJSONServer.GetTypedPayload[struct{ Option []string }](req, target, metric)
+
+To reject invalid payloads before the query function is called, create the server with the WithPayloadValidation option.
+The server then responds with http.StatusBadRequest, listing the invalid options of each target.
+
+WithTypedMetric removes the need to decode the payload in the query function altogether. The payload is decoded into
+the query function's payload type before the function is called:
+
+	type payload struct {
+		Option []string `json:"option"`
+	}
+
+	func query(_ context.Context, target string, p payload, _ grafanaJSONServer.QueryRequest) (grafanaJSONServer.QueryResponse, error) {
+		...
+	}
+
+	s := grafanaJSONServer.NewServer(grafanaJSONServer.WithTypedMetric(metric, query))
+
+If the metric has no Payloads, WithTypedMetric derives them from the payload type's struct tags. A derived select or
+multi-select option without "options" in its tag (e.g. a slice field without a tag) gets its options from the server,
+so WithTypedMetric panics unless the metric has a MetricPayloadOptionHandler (see WithMetricPayloadOptionHandler).
+
+To keep the metric's Payloads in line with the structure the payload is decoded into, PayloadsFromStruct derives the
+Payloads from the struct's "payload" tags:
+
+	type payload struct {
+		Option []string `json:"option" payload:"option,label=Option,width=40,options=Option 1:option1|Option 2:option2"`
+	}
+
+	payloads, err := grafanaJSONServer.PayloadsFromStruct(payload{})
+
 # Dynamic Metric Payload Options
 
 In the previous section, we configured a metric with hard-coded options. If we want to have dynamic options, we use
@@ -185,6 +360,18 @@ values for the variable:
 		}, nil
 	}
 
+If looking up the values takes a while, e.g. because it queries a database, use WithVariableHandler instead.
+A VariableHandler receives the request's context, which is cancelled if Grafana aborts the request:
+
+	s := grafanaJSONServer.NewServer(
+		grafanaJSONServer.WithVariableHandler("query0", grafanaJSONServer.VariableHandlerFunc(
+			func(ctx context.Context, _ grafanaJSONServer.VariableRequest) ([]grafanaJSONServer.Variable, error) {
+				return db.Values(ctx)
+			})),
+	)
+
+Likewise, WithMetricPayloadOptionHandler sets a context-aware MetricPayloadOptionHandler for a metric's payload options.
+
 A Query function can read the value of each variables by examining the ScopedVars in the QueryRequest:
 
 	var req grafanaJSONServer.QueryRequest
@@ -196,8 +383,8 @@ A Query function can read the value of each variables by examining the ScopedVar
 
 Note: in non-Raw JSON mode, GrafanaJSONDatasource stores the Query name in a json payload, with a "target" field holding the Query name.
 
-In Raw JSON mode, a user can specify any JSON structure as payload. To route the request to the correct VariableFunc,
-add a "target" field with the relevant name. If no "target" field is found, the request is routed to a VariableFunc with a
+In Raw JSON mode, a user can specify any JSON structure as payload. To route the request to the correct VariableHandler,
+add a "target" field with the relevant name. If no "target" field is found, the request is routed to a VariableHandler with a
 blank ("") target:
 
   - Query(non-raw): "foo" will route the request to "foo"
@@ -206,6 +393,70 @@ blank ("") target:
 
 See the Variable example for more.
 
+Variables can depend on each other. Grafana interpolates the values of other dashboard variables in the variable's
+query, so a "host" variable with the Raw JSON query { "target": "hosts", "clusters": ${cluster:json} } receives the
+selected clusters in its payload:
+
+	var payload struct {
+		Clusters []string `json:"clusters"`
+	}
+	err := req.GetPayload(&payload)
+
+See the ChainedVariables example for a cluster -> host -> disk chain.
+
+Grafana requests a variable's values each time a dashboard is loaded and, depending on the variable's Refresh setting,
+each time the time range changes. If looking up the values is expensive, use a VariableCache:
+
+	cache := grafanaJSONServer.NewVariableCache(grafanaJSONServer.VariableCacheOptions{TTL: 5 * time.Minute})
+	s := grafanaJSONServer.NewServer(
+		grafanaJSONServer.WithVariableHandler("hosts", cache.Handler(hostsHandler)),
+	)
+
+Values are cached per target, payload and scoped variables. By default, the time range is ignored. If the values depend
+on the time range, set VariableCacheOptions.Granularity: the time range is then aligned to the granularity and added to the cache key.
+
+To serve a family of variable queries with one handler, register it for a pattern rather than a name.
+WithVariablePattern takes a glob pattern, where "*" matches any sequence of characters and "?" any single character.
+WithVariableRegexp takes a regular expression. In both cases, the text matched by each wildcard or capture group is
+passed to the handler in the request's Matches:
+
+	s := grafanaJSONServer.NewServer(
+		grafanaJSONServer.WithVariablePattern("hosts/*", hostsHandler),                             // "hosts/prod": Matches = ["prod"]
+		grafanaJSONServer.WithVariableRegexp(regexp.MustCompile(`^tags\((\w+)\)$`), tagsHandler), // "tags(service)": Matches = ["service"]
+		grafanaJSONServer.WithDefaultVariableHandler(defaultHandler),
+	)
+
+A request is routed to the handler registered for its target's name, if there is one. Otherwise, it goes to the first
+pattern (in the order they were added) that matches the target and, failing that, to the default handler. If no handler
+is found, the server returns http.StatusBadRequest.
+
+# Ad hoc filters
+
+The JSON API datasource supports ad hoc filters. To offer the keys and values that can be used in a filter, create the server
+with the WithTagKeys and WithTagValues options:
+
+	s := grafanaJSONServer.NewServer(
+		grafanaJSONServer.WithTagKeys(tagKeysFunc),
+		grafanaJSONServer.WithTagValues(tagValuesFunc),
+	)
+
+A Query function can read the filters set in the dashboard by calling GetAdhocFilters on the QueryRequest:
+
+	filters, err := req.GetAdhocFilters()
+
+# Annotations
+
+To overlay events on a dashboard's panels, create the server with the WithAnnotationHandler option.
+The AnnotationHandler receives the annotation's query, as configured in the dashboard, and the time range of the dashboard:
+
+	func annotations(_ context.Context, req grafanaJSONServer.AnnotationRequest) ([]grafanaJSONServer.Annotation, error) {
+		return []grafanaJSONServer.Annotation{
+			{Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Title: "deployment", Text: "v1.0.0", Tags: []string{"prod"}},
+		}, nil
+	}
+
+If the Annotation's TimeEnd is set, the annotation covers a region, rather than a single point in time.
+
 [JSON API Grafana Datasource]: https://github.com/simPod/GrafanaJsonDatasource
 */
 package grafana_json_server
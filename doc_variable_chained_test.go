@@ -0,0 +1,82 @@
+package grafana_json_server_test
+
+import (
+	"cmp"
+	"context"
+	gjson "github.com/clambin/grafana-json-server"
+	"net/http"
+	"slices"
+)
+
+// inventory holds the disks of each host, per cluster.
+var inventory = map[string]map[string][]string{
+	"prod": {"prod-1": {"sda", "sdb"}, "prod-2": {"sda"}},
+	"test": {"test-1": {"nvme0n1"}},
+}
+
+// Example_chainedVariables shows a chain of dashboard variables, where each variable depends on the one before it:
+// cluster -> host -> disk. In Grafana, the variables are configured with the following Raw JSON queries:
+//
+//	cluster: { "target": "clusters" }
+//	host:    { "target": "hosts", "clusters": ${cluster:json} }
+//	disk:    { "target": "disks", "clusters": ${cluster:json}, "hosts": ${host:json} }
+//
+// Grafana interpolates the selected values of the upstream variables in the payload. The ":json" format sends them as
+// a JSON list, so multi-value variables are supported.
+func Example_chainedVariables() {
+	s := gjson.NewServer(
+		gjson.WithVariableHandler("clusters", gjson.VariableHandlerFunc(clusterVariables)),
+		gjson.WithVariableHandler("hosts", gjson.VariableHandlerFunc(hostVariables)),
+		gjson.WithVariableHandler("disks", gjson.VariableHandlerFunc(diskVariables)),
+	)
+
+	_ = http.ListenAndServe(":8080", s)
+}
+
+func clusterVariables(_ context.Context, _ gjson.VariableRequest) ([]gjson.Variable, error) {
+	variables := make([]gjson.Variable, 0, len(inventory))
+	for cluster := range inventory {
+		variables = append(variables, gjson.Variable{Text: cluster, Value: cluster})
+	}
+	return sortVariables(variables), nil
+}
+
+func hostVariables(_ context.Context, req gjson.VariableRequest) ([]gjson.Variable, error) {
+	var payload struct {
+		Clusters []string `json:"clusters"`
+	}
+	if err := req.GetPayload(&payload); err != nil {
+		return nil, err
+	}
+	var variables []gjson.Variable
+	for _, cluster := range payload.Clusters {
+		for host := range inventory[cluster] {
+			variables = append(variables, gjson.Variable{Text: host, Value: host})
+		}
+	}
+	return sortVariables(variables), nil
+}
+
+func diskVariables(_ context.Context, req gjson.VariableRequest) ([]gjson.Variable, error) {
+	var payload struct {
+		Clusters []string `json:"clusters"`
+		Hosts    []string `json:"hosts"`
+	}
+	if err := req.GetPayload(&payload); err != nil {
+		return nil, err
+	}
+	var variables []gjson.Variable
+	for _, cluster := range payload.Clusters {
+		for _, host := range payload.Hosts {
+			for _, disk := range inventory[cluster][host] {
+				variables = append(variables, gjson.Variable{Text: host + ":" + disk, Value: host + ":" + disk})
+			}
+		}
+	}
+	return sortVariables(variables), nil
+}
+
+func sortVariables(variables []gjson.Variable) []gjson.Variable {
+	slices.SortFunc(variables, func(a, b gjson.Variable) int { return cmp.Compare(a.Value, b.Value) })
+	return variables
+}
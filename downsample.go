@@ -0,0 +1,329 @@
+package grafana_json_server
+
+import (
+	"math"
+)
+
+// DownsampleMethod determines how the server reduces the number of data points of a query response to the
+// MaxDataPoints requested by Grafana. See WithDownsampling and WithMetricDownsampling.
+type DownsampleMethod int
+
+const (
+	// DownsampleNone returns the query response as is. This is the default.
+	DownsampleNone DownsampleMethod = iota
+	// DownsampleLTTB uses the Largest-Triangle-Three-Buckets algorithm, which keeps the visual shape of the data.
+	DownsampleLTTB
+	// DownsampleMinMax divides the data in buckets and keeps the minimum and maximum data point of each bucket.
+	DownsampleMinMax
+	// DownsampleAverage divides the data in buckets and replaces each bucket by the average of its values.
+	// The timestamp of the first data point in the bucket is used as the timestamp of the bucket.
+	DownsampleAverage
+)
+
+// downsample reduces the number of data points in a TimeSeriesResponse, MultiTimeSeriesResponse or time-indexed
+// TableResponse to maxDataPoints. For a TableResponse, LTTB and MinMax select rows based on the first numerical column.
+// Average averages all numerical columns and takes the first value of the bucket for all other columns.
+//
+// Other responses are returned as is.
+func downsample(resp QueryResponse, maxDataPoints int, method DownsampleMethod) QueryResponse {
+	if method == DownsampleNone || maxDataPoints <= 0 {
+		return resp
+	}
+	switch r := resp.(type) {
+	case TimeSeriesResponse:
+		r.DataPoints = downsampleDataPoints(r.DataPoints, maxDataPoints, method)
+		return r
+	case MultiTimeSeriesResponse:
+		output := make(MultiTimeSeriesResponse, len(r))
+		for i, timeSeries := range r {
+			output[i] = downsample(timeSeries, maxDataPoints, method).(TimeSeriesResponse)
+		}
+		return output
+	case TableResponse:
+		return downsampleTable(r, maxDataPoints, method)
+	default:
+		return resp
+	}
+}
+
+func downsampleDataPoints(dataPoints []DataPoint, maxDataPoints int, method DownsampleMethod) []DataPoint {
+	if len(dataPoints) <= maxDataPoints {
+		return dataPoints
+	}
+
+	if method == DownsampleAverage {
+		output := make([]DataPoint, 0, maxDataPoints)
+		for _, b := range makeBuckets(len(dataPoints), maxDataPoints) {
+			var sum float64
+			for _, dataPoint := range dataPoints[b.start:b.end] {
+				sum += dataPoint.Value
+			}
+			output = append(output, DataPoint{Timestamp: dataPoints[b.start].Timestamp, Value: sum / float64(b.end-b.start)})
+		}
+		return output
+	}
+
+	x := make([]float64, len(dataPoints))
+	y := make([]float64, len(dataPoints))
+	for i, dataPoint := range dataPoints {
+		x[i] = float64(dataPoint.Timestamp.UnixMilli())
+		y[i] = dataPoint.Value
+	}
+	return pick(dataPoints, selectIndices(x, y, maxDataPoints, method))
+}
+
+func downsampleTable(t TableResponse, maxDataPoints int, method DownsampleMethod) TableResponse {
+	_, rowCount, err := t.getColumnDetails()
+	if err != nil || rowCount <= maxDataPoints {
+		return t
+	}
+
+	var timestamps TimeColumn
+	var values []float64
+	for _, column := range t.Columns {
+		if data, ok := column.Data.(TimeColumn); ok && timestamps == nil {
+			timestamps = data
+		}
+		if values == nil {
+			values = numericValues(column.Data)
+		}
+	}
+	if timestamps == nil {
+		return t
+	}
+
+	output := TableResponse{Columns: make([]Column, len(t.Columns))}
+
+	if method == DownsampleAverage {
+		buckets := makeBuckets(rowCount, maxDataPoints)
+		for i, column := range t.Columns {
+			output.Columns[i] = Column{Text: column.Text, Data: averageColumn(column.Data, buckets)}
+		}
+		return output
+	}
+
+	if values == nil {
+		values = make([]float64, rowCount)
+	}
+	x := make([]float64, rowCount)
+	for i, timestamp := range timestamps {
+		x[i] = float64(timestamp.UnixMilli())
+	}
+	indices := selectIndices(x, values, maxDataPoints, method)
+	for i, column := range t.Columns {
+		output.Columns[i] = Column{Text: column.Text, Data: pickColumn(column.Data, indices)}
+	}
+	return output
+}
+
+// selectIndices returns the indices of the data points to keep for the LTTB and MinMax methods.
+func selectIndices(x, y []float64, maxDataPoints int, method DownsampleMethod) []int {
+	if method == DownsampleMinMax {
+		return minMaxIndices(y, maxDataPoints)
+	}
+	return lttbIndices(x, y, maxDataPoints)
+}
+
+// bucket holds the data points [start, end).
+type bucket struct {
+	start int
+	end   int
+}
+
+// makeBuckets divides size data points into count buckets of (roughly) equal size. size must be larger than count.
+func makeBuckets(size, count int) []bucket {
+	buckets := make([]bucket, count)
+	for i := range buckets {
+		buckets[i] = bucket{start: i * size / count, end: (i + 1) * size / count}
+	}
+	return buckets
+}
+
+// bucketStarts divides size data points into count buckets and returns the index of the first data point of each bucket.
+func bucketStarts(size, count int) []int {
+	indices := make([]int, 0, count)
+	for _, b := range makeBuckets(size, count) {
+		indices = append(indices, b.start)
+	}
+	return indices
+}
+
+func lttbIndices(x, y []float64, threshold int) []int {
+	size := len(x)
+	if threshold < 3 {
+		// LTTB needs at least three points (first, last and one in between). Take the first data point of each bucket instead.
+		return bucketStarts(size, threshold)
+	}
+
+	indices := make([]int, 0, threshold)
+	indices = append(indices, 0)
+	every := float64(size-2) / float64(threshold-2)
+	var a int
+	for i := 0; i < threshold-2; i++ {
+		// average of the next bucket
+		avgStart := int(float64(i+1)*every) + 1
+		avgEnd := min(int(float64(i+2)*every)+1, size)
+		var avgX, avgY float64
+		for j := avgStart; j < avgEnd; j++ {
+			avgX += x[j]
+			avgY += y[j]
+		}
+		avgX /= float64(avgEnd - avgStart)
+		avgY /= float64(avgEnd - avgStart)
+
+		// pick the point in the current bucket that forms the largest triangle with the previous point and the next bucket's average
+		rangeStart := int(float64(i)*every) + 1
+		rangeEnd := int(float64(i+1)*every) + 1
+		maxArea := -1.0
+		next := rangeStart
+		for j := rangeStart; j < rangeEnd; j++ {
+			area := math.Abs((x[a]-avgX)*(y[j]-y[a]) - (x[a]-x[j])*(avgY-y[a]))
+			if area > maxArea {
+				maxArea, next = area, j
+			}
+		}
+		indices = append(indices, next)
+		a = next
+	}
+	return append(indices, size-1)
+}
+
+func minMaxIndices(y []float64, maxDataPoints int) []int {
+	if maxDataPoints < 2 {
+		// each bucket may return two points (its minimum and maximum). Take the first data point of each bucket instead.
+		return bucketStarts(len(y), maxDataPoints)
+	}
+	indices := make([]int, 0, maxDataPoints)
+	for _, b := range makeBuckets(len(y), maxDataPoints/2) {
+		minIndex, maxIndex := b.start, b.start
+		for i := b.start + 1; i < b.end; i++ {
+			if y[i] < y[minIndex] {
+				minIndex = i
+			}
+			if y[i] > y[maxIndex] {
+				maxIndex = i
+			}
+		}
+		indices = append(indices, min(minIndex, maxIndex))
+		if minIndex != maxIndex {
+			indices = append(indices, max(minIndex, maxIndex))
+		}
+	}
+	return indices
+}
+
+// numericValues returns the values of a numerical column as float64. Null values are returned as zero.
+// If the column is not numerical, numericValues returns nil.
+func numericValues(data any) []float64 {
+	switch data := data.(type) {
+	case NumberColumn:
+		return data
+	case IntColumn:
+		return convert(data, func(v int64) float64 { return float64(v) })
+	case NullableNumberColumn:
+		return convert(data, func(v *float64) float64 { return valueOrZero(v) })
+	case NullableIntColumn:
+		return convert(data, func(v *int64) float64 { return float64(valueOrZero(v)) })
+	default:
+		return nil
+	}
+}
+
+func averageColumn(data any, buckets []bucket) any {
+	switch data := data.(type) {
+	case NumberColumn:
+		return NumberColumn(averageBuckets(data, buckets, func(v float64) (float64, bool) { return v, true }))
+	case IntColumn:
+		return NumberColumn(averageBuckets(data, buckets, func(v int64) (float64, bool) { return float64(v), true }))
+	case NullableNumberColumn:
+		return NullableNumberColumn(averageNullableBuckets(data, buckets, func(v *float64) (float64, bool) { return valueOrZero(v), v != nil }))
+	case NullableIntColumn:
+		return NullableNumberColumn(averageNullableBuckets(data, buckets, func(v *int64) (float64, bool) { return float64(valueOrZero(v)), v != nil }))
+	default:
+		starts := make([]int, len(buckets))
+		for i, b := range buckets {
+			starts[i] = b.start
+		}
+		return pickColumn(data, starts)
+	}
+}
+
+func averageBuckets[T any](values []T, buckets []bucket, get func(T) (float64, bool)) []float64 {
+	output := make([]float64, len(buckets))
+	for i, avg := range averageNullableBuckets(values, buckets, get) {
+		output[i] = valueOrZero(avg)
+	}
+	return output
+}
+
+// averageNullableBuckets returns the average of the values in each bucket, skipping null values. If a bucket only
+// holds null values, its average is nil.
+func averageNullableBuckets[T any](values []T, buckets []bucket, get func(T) (float64, bool)) []*float64 {
+	output := make([]*float64, len(buckets))
+	for i, b := range buckets {
+		var sum float64
+		var count int
+		for _, value := range values[b.start:b.end] {
+			if v, ok := get(value); ok {
+				sum += v
+				count++
+			}
+		}
+		if count > 0 {
+			avg := sum / float64(count)
+			output[i] = &avg
+		}
+	}
+	return output
+}
+
+func pickColumn(data any, indices []int) any {
+	switch data := data.(type) {
+	case TimeColumn:
+		return pick(data, indices)
+	case StringColumn:
+		return pick(data, indices)
+	case NumberColumn:
+		return pick(data, indices)
+	case IntColumn:
+		return pick(data, indices)
+	case BoolColumn:
+		return pick(data, indices)
+	case NullableTimeColumn:
+		return pick(data, indices)
+	case NullableStringColumn:
+		return pick(data, indices)
+	case NullableNumberColumn:
+		return pick(data, indices)
+	case NullableIntColumn:
+		return pick(data, indices)
+	case NullableBoolColumn:
+		return pick(data, indices)
+	default:
+		return data
+	}
+}
+
+func pick[S ~[]T, T any](values S, indices []int) S {
+	output := make(S, len(indices))
+	for i, index := range indices {
+		output[i] = values[index]
+	}
+	return output
+}
+
+func convert[S ~[]T, T any](values S, f func(T) float64) []float64 {
+	output := make([]float64, len(values))
+	for i, value := range values {
+		output[i] = f(value)
+	}
+	return output
+}
+
+func valueOrZero[T any](v *T) T {
+	var zero T
+	if v == nil {
+		return zero
+	}
+	return *v
+}
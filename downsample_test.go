@@ -0,0 +1,195 @@
+package grafana_json_server_test
+
+import (
+	"context"
+	"encoding/json"
+	gjson "github.com/clambin/grafana-json-server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithDownsampling_TimeSeries(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	dataPoints := make([]gjson.DataPoint, 100)
+	for i := range dataPoints {
+		dataPoints[i] = gjson.DataPoint{Timestamp: start.Add(time.Duration(i) * time.Minute), Value: float64(i % 10)}
+	}
+	// add a spike that should survive LTTB and MinMax
+	dataPoints[55].Value = 100
+	handler := gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+		return gjson.TimeSeriesResponse{Target: target, DataPoints: dataPoints}, nil
+	})
+
+	tests := []struct {
+		name          string
+		method        gjson.DownsampleMethod
+		maxDataPoints int
+		wantCount     int
+		want          func(t *testing.T, values []float64, timestamps []int64)
+	}{
+		{
+			name:          "none",
+			method:        gjson.DownsampleNone,
+			maxDataPoints: 10,
+			wantCount:     100,
+		},
+		{
+			name:          "no max data points",
+			method:        gjson.DownsampleLTTB,
+			maxDataPoints: 0,
+			wantCount:     100,
+		},
+		{
+			name:          "lttb",
+			method:        gjson.DownsampleLTTB,
+			maxDataPoints: 10,
+			wantCount:     10,
+			want: func(t *testing.T, values []float64, timestamps []int64) {
+				assert.Equal(t, start.UnixMilli(), timestamps[0])
+				assert.Equal(t, start.Add(99*time.Minute).UnixMilli(), timestamps[9])
+				assert.Contains(t, values, 100.0)
+			},
+		},
+		{
+			name:          "minmax",
+			method:        gjson.DownsampleMinMax,
+			maxDataPoints: 10,
+			wantCount:     10,
+			want: func(t *testing.T, values []float64, _ []int64) {
+				assert.Equal(t, []float64{0, 9, 0, 9, 0, 100, 0, 9, 0, 9}, values)
+			},
+		},
+		{
+			name:          "minmax - one data point",
+			method:        gjson.DownsampleMinMax,
+			maxDataPoints: 1,
+			wantCount:     1,
+			want: func(t *testing.T, values []float64, timestamps []int64) {
+				assert.Equal(t, []float64{0}, values)
+				assert.Equal(t, start.UnixMilli(), timestamps[0])
+			},
+		},
+		{
+			name:          "lttb - one data point",
+			method:        gjson.DownsampleLTTB,
+			maxDataPoints: 1,
+			wantCount:     1,
+		},
+		{
+			name:          "average",
+			method:        gjson.DownsampleAverage,
+			maxDataPoints: 10,
+			wantCount:     10,
+			want: func(t *testing.T, values []float64, timestamps []int64) {
+				assert.Equal(t, []float64{4.5, 4.5, 4.5, 4.5, 4.5, 14, 4.5, 4.5, 4.5, 4.5}, values)
+				assert.Equal(t, start.Add(10*time.Minute).UnixMilli(), timestamps[1])
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := gjson.NewServer(gjson.WithDownsampling(tt.method), gjson.WithHandler("foo", handler))
+			body := queryServer(t, s, `{ "maxDataPoints": `+strconv.Itoa(tt.maxDataPoints)+`, "targets": [ { "target": "foo" } ] }`)
+
+			var resp []struct {
+				Target     string
+				DataPoints [][2]float64
+			}
+			require.NoError(t, json.Unmarshal(body, &resp))
+			require.Len(t, resp, 1)
+			require.Len(t, resp[0].DataPoints, tt.wantCount)
+
+			values := make([]float64, len(resp[0].DataPoints))
+			timestamps := make([]int64, len(resp[0].DataPoints))
+			for i, dataPoint := range resp[0].DataPoints {
+				values[i] = dataPoint[0]
+				timestamps[i] = int64(dataPoint[1])
+			}
+			if tt.want != nil {
+				tt.want(t, values, timestamps)
+			}
+		})
+	}
+}
+
+func TestWithDownsampling_Table(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	timestamps := make(gjson.TimeColumn, 6)
+	labels := make(gjson.StringColumn, 6)
+	values := make(gjson.NumberColumn, 6)
+	counts := make(gjson.NullableIntColumn, 6)
+	for i := range timestamps {
+		timestamps[i] = start.Add(time.Duration(i) * time.Minute)
+		labels[i] = strconv.Itoa(i)
+		values[i] = float64(i)
+		if i%3 != 0 {
+			counts[i] = ptr(int64(i))
+		}
+	}
+	table := gjson.TableResponse{Columns: []gjson.Column{
+		{Text: "time", Data: timestamps},
+		{Text: "label", Data: labels},
+		{Text: "value", Data: values},
+		{Text: "count", Data: counts},
+	}}
+	handler := gjson.HandlerFunc(func(_ context.Context, _ string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+		return table, nil
+	})
+	untimed := gjson.HandlerFunc(func(_ context.Context, _ string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+		return gjson.TableResponse{Columns: table.Columns[1:]}, nil
+	})
+
+	s := gjson.NewServer(
+		gjson.WithDownsampling(gjson.DownsampleAverage),
+		gjson.WithHandler("average", handler),
+		gjson.WithMetric(gjson.Metric{Value: "minmax"}, handler, nil, gjson.WithMetricDownsampling(gjson.DownsampleMinMax)),
+		gjson.WithMetric(gjson.Metric{Value: "none"}, handler, nil, gjson.WithMetricDownsampling(gjson.DownsampleNone)),
+		gjson.WithHandler("untimed", untimed),
+	)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{
+			target: "average",
+			want:   `[{"type":"table","columns":[{"text":"time","type":"time"},{"text":"label","type":"string"},{"text":"value","type":"number"},{"text":"count","type":"number"}],"rows":[["2024-01-01T00:00:00Z","0",1,1.5],["2024-01-01T00:03:00Z","3",4,4.5]]}]`,
+		},
+		{
+			target: "minmax",
+			want:   `[{"type":"table","columns":[{"text":"time","type":"time"},{"text":"label","type":"string"},{"text":"value","type":"number"},{"text":"count","type":"number"}],"rows":[["2024-01-01T00:00:00Z","0",0,null],["2024-01-01T00:05:00Z","5",5,5]]}]`,
+		},
+		{
+			target: "none",
+			want:   `[{"type":"table","columns":[{"text":"time","type":"time"},{"text":"label","type":"string"},{"text":"value","type":"number"},{"text":"count","type":"number"}],"rows":[["2024-01-01T00:00:00Z","0",0,null],["2024-01-01T00:01:00Z","1",1,1],["2024-01-01T00:02:00Z","2",2,2],["2024-01-01T00:03:00Z","3",3,null],["2024-01-01T00:04:00Z","4",4,4],["2024-01-01T00:05:00Z","5",5,5]]}]`,
+		},
+		{
+			target: "untimed",
+			want:   `[{"type":"table","columns":[{"text":"label","type":"string"},{"text":"value","type":"number"},{"text":"count","type":"number"}],"rows":[["0",0,null],["1",1,1],["2",2,2],["3",3,null],["4",4,4],["5",5,5]]}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			body := queryServer(t, s, `{ "maxDataPoints": 2, "targets": [ { "target": "`+tt.target+`" } ] }`)
+			assert.Equal(t, tt.want+"\n", string(body))
+		})
+	}
+}
+
+func queryServer(t *testing.T, s http.Handler, request string) []byte {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/query", io.NopCloser(strings.NewReader(request)))
+	s.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	return w.Body.Bytes()
+}
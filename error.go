@@ -0,0 +1,105 @@
+package grafana_json_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A QueryError is an error that a Handler can return to control what is shown to the user when the query fails.
+// Message is returned to Grafana, while Err holds the internal cause and is only logged.
+//
+// When query error reporting is enabled (see WithQueryErrorReporting), errors that are not a QueryError are reported
+// to Grafana with a generic message, so internal details are not exposed.
+type QueryError struct {
+	Message string
+	Err     error
+}
+
+// Error returns the message of the QueryError, followed by its internal cause, if any.
+func (e *QueryError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+// Unwrap returns the internal cause of the QueryError.
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// A PanicError is returned when a Handler, VariableHandler or MetricPayloadOptionHandler panics.
+// Value holds the value passed to panic and Stack holds the stack trace of the panicking goroutine.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+// Error returns the value passed to panic.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// errInvalidTarget is returned for a target that does not match any metric.
+var errInvalidTarget = errors.New("invalid target")
+
+// targetError is the user-visible error of one failed target in a query request.
+type targetError struct {
+	RefID   string              `json:"refId"`
+	Target  string              `json:"target"`
+	Message string              `json:"message"`
+	Fields  []PayloadFieldError `json:"fields,omitempty"`
+	err     error
+}
+
+func newTargetError(target QueryRequestTarget, err error) targetError {
+	message := "query failed"
+	var fields []PayloadFieldError
+	var queryError *QueryError
+	var validationError *PayloadValidationError
+	switch {
+	case errors.As(err, &queryError):
+		message = queryError.Message
+	case errors.As(err, &validationError):
+		message = validationError.Error()
+		fields = validationError.Fields
+	case errors.Is(err, ErrQueryTimeout):
+		message = ErrQueryTimeout.Error()
+	case errors.Is(err, errInvalidTarget):
+		message = err.Error()
+	}
+	return targetError{RefID: target.RefID, Target: target.Target, Message: message, Fields: fields, err: err}
+}
+
+// writeTargetErrors reports the failed targets to Grafana. The JSON API datasource shows the top-level message field.
+// If all targets failed because they don't exist or have an invalid payload, the status is http.StatusBadRequest.
+// Otherwise, it's http.StatusInternalServerError.
+func writeTargetErrors(w http.ResponseWriter, errs []targetError) {
+	statusCode := http.StatusBadRequest
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		if !isRequestError(err.err) {
+			statusCode = http.StatusInternalServerError
+		}
+		messages[i] = err.RefID + ": " + err.Message
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(struct {
+		Message string        `json:"message"`
+		Errors  []targetError `json:"errors"`
+	}{
+		Message: strings.Join(messages, "; "),
+		Errors:  errs,
+	})
+}
+
+// isRequestError returns true if the error is caused by an invalid request, rather than a failing query.
+func isRequestError(err error) bool {
+	var validationError *PayloadValidationError
+	return errors.Is(err, errInvalidTarget) || errors.As(err, &validationError)
+}
@@ -0,0 +1,20 @@
+package grafana_json_server_test
+
+import (
+	"errors"
+	gjson "github.com/clambin/grafana-json-server"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestQueryError(t *testing.T) {
+	errBackend := errors.New("connection refused")
+
+	err := error(&gjson.QueryError{Message: "backend unavailable", Err: errBackend})
+	assert.Equal(t, "backend unavailable: connection refused", err.Error())
+	assert.ErrorIs(t, err, errBackend)
+
+	err = &gjson.QueryError{Message: "backend unavailable"}
+	assert.Equal(t, "backend unavailable", err.Error())
+	assert.NoError(t, errors.Unwrap(err))
+}
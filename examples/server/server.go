@@ -15,35 +15,14 @@ import (
 func main() {
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})))
 
+	payloads, err := grafanaJSONServer.PayloadsFromStruct(payload{})
+	if err != nil {
+		panic(err)
+	}
 	m1 := grafanaJSONServer.Metric{
-		Label: "Metric 1",
-		Value: "foo",
-		Payloads: []grafanaJSONServer.MetricPayload{
-			{
-				Label:        "Option 1",
-				Name:         "option1",
-				Type:         "select",
-				Placeholder:  "",
-				ReloadMetric: false,
-				Width:        40,
-				Options: []grafanaJSONServer.MetricPayloadOption{
-					{
-						Label: "Value 1",
-						Value: "value 1",
-					},
-					{
-						Label: "Value 2",
-						Value: "value 2",
-					},
-				},
-			},
-			{
-				Label: "Option 2",
-				Name:  "option2",
-				Type:  "multi-select",
-				Width: 40,
-			},
-		},
+		Label:    "Metric 1",
+		Value:    "foo",
+		Payloads: payloads,
 	}
 	m2 := grafanaJSONServer.Metric{
 		Label: "Metric 2",
@@ -67,11 +46,13 @@ func main() {
 	}
 }
 
+type payload struct {
+	Option1 string   `json:"option1" payload:"option1,type=select,label=Option 1,width=40,options=Value 1:value 1|Value 2:value 2"`
+	Option2 []string `json:"option2" payload:"option2,label=Option 2,width=40"`
+}
+
 func getMetricPayloadOptions(req grafanaJSONServer.MetricPayloadOptionsRequest) ([]grafanaJSONServer.MetricPayloadOption, error) {
-	var payload struct {
-		Option1 string
-		Option2 []string
-	}
+	var payload payload
 	slog.Info("getMetricPayloadOptions called", "metric", req.Metric, "name", req.Name)
 	if err := req.GetPayload(&payload); err != nil {
 		slog.Error("failed", "err", err)
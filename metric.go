@@ -1,6 +1,7 @@
 package grafana_json_server
 
 import (
+	"context"
 	"encoding/json"
 )
 
@@ -17,7 +18,8 @@ type Metric struct {
 // A MetricPayload configures a payload options for a metric.
 //
 // If the metric is of Type "select", or "multi-select", Options should contain all possible values for the metric.
-// Alternatively, it may be nil, in which case you should pass a MetricPayloadOptionFunc when calling WithMetric.
+// Alternatively, it may be nil, in which case you should pass a MetricPayloadOptionFunc when calling WithMetric, or set
+// a MetricPayloadOptionHandler with WithMetricPayloadOptionHandler.
 type MetricPayload struct {
 	// Label is the name of the option, as shown on the screen.
 	Label string `json:"label,omitempty"`
@@ -51,9 +53,32 @@ type MetricPayloadOption struct {
 
 // MetricPayloadOptionFunc is the function signature of the metric payload option function, provided to WithMetric.
 // It is called when a metric has a payload with a nil Options field and returns the possible options for the requested Metric payload.
+//
+// Unlike a MetricPayloadOptionHandler, a MetricPayloadOptionFunc does not receive the request's context.
+// MetricPayloadOptionFunc implements MetricPayloadOptionHandler, by ignoring the context.
 type MetricPayloadOptionFunc func(MetricPayloadOptionsRequest) ([]MetricPayloadOption, error)
 
-// MetricPayloadOptionsRequest is the request provided to MetricPayloadOptionFunc.
+// PayloadOptions calls f(req)
+func (f MetricPayloadOptionFunc) PayloadOptions(_ context.Context, req MetricPayloadOptionsRequest) ([]MetricPayloadOption, error) {
+	return f(req)
+}
+
+// A MetricPayloadOptionHandler returns the possible options for a metric payload that has a nil Options field.
+// Use WithMetricPayloadOptionHandler to set the MetricPayloadOptionHandler of a metric.
+type MetricPayloadOptionHandler interface {
+	PayloadOptions(ctx context.Context, req MetricPayloadOptionsRequest) ([]MetricPayloadOption, error)
+}
+
+// The MetricPayloadOptionHandlerFunc type is an adapter to allow the use of an ordinary function as a MetricPayloadOptionHandler.
+// If f is a function with the appropriate signature, then MetricPayloadOptionHandlerFunc(f) is a MetricPayloadOptionHandler that calls f.
+type MetricPayloadOptionHandlerFunc func(ctx context.Context, req MetricPayloadOptionsRequest) ([]MetricPayloadOption, error)
+
+// PayloadOptions calls f(ctx, req)
+func (f MetricPayloadOptionHandlerFunc) PayloadOptions(ctx context.Context, req MetricPayloadOptionsRequest) ([]MetricPayloadOption, error) {
+	return f(ctx, req)
+}
+
+// MetricPayloadOptionsRequest is the request provided to a MetricPayloadOptionHandler.
 type MetricPayloadOptionsRequest struct {
 	Metric  string          `json:"metric"`
 	Name    string          `json:"name"`
@@ -0,0 +1,94 @@
+package grafana_json_server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+)
+
+// A Middleware adds behaviour to a Handler, by returning a Handler that wraps it.
+// Use WithQueryMiddleware to apply Middleware to the Handlers of all metrics.
+type Middleware func(Handler) Handler
+
+// chain applies the middleware to the handler. The first middleware is the outermost one, i.e. it's called first.
+func chain(handler Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// LoggingMiddleware logs each query, with its duration and result, to the provided logger.
+// Successful queries are logged at debug level. Failed queries are logged at warning level.
+func LoggingMiddleware(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, target string, req QueryRequest) (QueryResponse, error) {
+			start := time.Now()
+			resp, err := next.Query(ctx, target, req)
+			attrs := []any{"target", target, "duration", time.Since(start)}
+			if requestID, ok := RequestIDFromContext(ctx); ok {
+				attrs = append(attrs, "requestId", requestID)
+			}
+			if err != nil {
+				logger.Warn("query failed", append(attrs, "err", err)...)
+			} else {
+				logger.Debug("query", attrs...)
+			}
+			return resp, err
+		})
+	}
+}
+
+// RecoveryMiddleware recovers from a panic in the Handler and returns it as a PanicError.
+//
+// The server already recovers from panics in Handlers. Use RecoveryMiddleware to recover before the panic reaches
+// any Middleware earlier in the chain.
+func RecoveryMiddleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, target string, req QueryRequest) (QueryResponse, error) {
+			return safeQuery(ctx, next, target, req)
+		})
+	}
+}
+
+// TimingMiddleware calls observe with the duration of each query.
+func TimingMiddleware(observe func(target string, duration time.Duration)) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, target string, req QueryRequest) (QueryResponse, error) {
+			start := time.Now()
+			defer func() { observe(target, time.Since(start)) }()
+			return next.Query(ctx, target, req)
+		})
+	}
+}
+
+type requestIDKey struct{}
+
+// RequestIDMiddleware tags the context passed to the Handler with the request's ID. If Grafana didn't send a
+// request ID, the server generates a random one for each query request, shared by all its targets. Use
+// RequestIDFromContext to retrieve it.
+func RequestIDMiddleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, target string, req QueryRequest) (QueryResponse, error) {
+			requestID := req.RequestID
+			if requestID == "" {
+				requestID = newRequestID()
+			}
+			return next.Query(context.WithValue(ctx, requestIDKey{}, requestID), target, req)
+		})
+	}
+}
+
+// RequestIDFromContext returns the request ID set by RequestIDMiddleware.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	requestID, ok := ctx.Value(requestIDKey{}).(string)
+	return requestID, ok
+}
+
+func newRequestID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,122 @@
+package grafana_json_server_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	gjson "github.com/clambin/grafana-json-server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	okHandler = gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+		return gjson.TimeSeriesResponse{Target: target}, nil
+	})
+	failingHandler = gjson.HandlerFunc(func(_ context.Context, _ string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+		return nil, errors.New("failed")
+	})
+)
+
+func TestLoggingMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey || a.Key == "duration" {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	m := gjson.LoggingMiddleware(l)
+
+	_, err := m(okHandler).Query(context.Background(), "foo", gjson.QueryRequest{})
+	require.NoError(t, err)
+	_, err = gjson.RequestIDMiddleware()(m(failingHandler)).Query(context.Background(), "bar", gjson.QueryRequest{RequestID: "Q1"})
+	require.Error(t, err)
+
+	assert.Equal(t, `level=DEBUG msg=query target=foo
+level=WARN msg="query failed" target=bar requestId=Q1 err=failed
+`, out.String())
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	h := gjson.RecoveryMiddleware()(gjson.HandlerFunc(func(_ context.Context, _ string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+		panic("oops")
+	}))
+
+	resp, err := h.Query(context.Background(), "foo", gjson.QueryRequest{})
+	assert.Nil(t, resp)
+	var panicErr *gjson.PanicError
+	require.ErrorAs(t, err, &panicErr)
+	assert.Equal(t, "oops", panicErr.Value)
+	assert.EqualError(t, err, "panic: oops")
+
+	resp, err = gjson.RecoveryMiddleware()(okHandler).Query(context.Background(), "foo", gjson.QueryRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, gjson.TimeSeriesResponse{Target: "foo"}, resp)
+}
+
+func TestTimingMiddleware(t *testing.T) {
+	var observed []string
+	h := gjson.TimingMiddleware(func(target string, duration time.Duration) {
+		observed = append(observed, target)
+		assert.GreaterOrEqual(t, duration, 10*time.Millisecond)
+	})(gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+		time.Sleep(10 * time.Millisecond)
+		return nil, nil
+	}))
+
+	_, _ = h.Query(context.Background(), "foo", gjson.QueryRequest{})
+	assert.Equal(t, []string{"foo"}, observed)
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var requestID string
+	h := gjson.RequestIDMiddleware()(gjson.HandlerFunc(func(ctx context.Context, _ string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+		var ok bool
+		requestID, ok = gjson.RequestIDFromContext(ctx)
+		require.True(t, ok)
+		return nil, nil
+	}))
+
+	_, _ = h.Query(context.Background(), "foo", gjson.QueryRequest{RequestID: "Q100"})
+	assert.Equal(t, "Q100", requestID)
+
+	_, _ = h.Query(context.Background(), "foo", gjson.QueryRequest{})
+	assert.Len(t, requestID, 16)
+
+	_, ok := gjson.RequestIDFromContext(context.Background())
+	assert.False(t, ok)
+}
+
+func TestRequestIDMiddleware_Server(t *testing.T) {
+	var lock sync.Mutex
+	requestIDs := make(map[string]string)
+	s := gjson.NewServer(
+		gjson.WithQueryMiddleware(gjson.RequestIDMiddleware()),
+		gjson.WithHandler("foo", gjson.HandlerFunc(func(ctx context.Context, target string, req gjson.QueryRequest) (gjson.QueryResponse, error) {
+			requestID, _ := gjson.RequestIDFromContext(ctx)
+			lock.Lock()
+			defer lock.Unlock()
+			requestIDs[req.Target.RefID] = requestID
+			return gjson.TimeSeriesResponse{Target: target}, nil
+		})),
+	)
+
+	_ = queryServer(t, s, `{ "targets": [ { "target": "foo", "refId": "A" }, { "target": "foo", "refId": "B" }, { "target": "foo", "refId": "C" } ] }`)
+	require.Len(t, requestIDs, 3)
+	assert.Len(t, requestIDs["A"], 16)
+	assert.Equal(t, requestIDs["A"], requestIDs["B"])
+	assert.Equal(t, requestIDs["A"], requestIDs["C"])
+
+	// a new request gets a new ID
+	firstID := requestIDs["A"]
+	_ = queryServer(t, s, `{ "targets": [ { "target": "foo", "refId": "A" } ] }`)
+	assert.NotEqual(t, firstID, requestIDs["A"])
+}
@@ -1,8 +1,14 @@
 package grafana_json_server
 
 import (
+	"compress/gzip"
+	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"reflect"
+	"regexp"
+	"time"
 )
 
 // Option configures a Server.
@@ -16,16 +22,60 @@ func WithLogger(l *slog.Logger) Option {
 }
 
 // WithMetric adds a new metric to the server. See Metric for more configuration options for a metric.
-func WithMetric(m Metric, handler Handler, payloadOption MetricPayloadOptionFunc) Option {
+// Use MetricOption items to further configure how the server handles the metric.
+func WithMetric(m Metric, handler Handler, payloadOption MetricPayloadOptionFunc, options ...MetricOption) Option {
 	return func(s *Server) {
-		s.metricConfigs[m.Value] = metric{
-			Metric:                  m,
-			MetricPayloadOptionFunc: payloadOption,
-			Handler:                 handler,
+		config := metric{
+			Metric:  m,
+			Handler: handler,
 		}
+		if payloadOption != nil {
+			config.payloadOptions = payloadOption
+		}
+		for _, option := range options {
+			option(&config)
+		}
+		s.metricConfigs[m.Value] = config
 	}
 }
 
+// WithTypedMetric adds a new metric to the server, whose payload is decoded into a value of type P before calling
+// the query function. If the payload can't be decoded, the query fails with a PayloadValidationError.
+//
+// If the Metric has no Payloads and P is a struct, the Payloads are derived from P's "payload" tags (see PayloadsFromStruct).
+// WithTypedMetric panics if P's tags are invalid.
+//
+// Grafana calls the server for the options of a select or multi-select payload without Options, e.g. a slice field
+// without an "options" tag. WithTypedMetric therefore also panics if such a payload is derived from P and no
+// MetricPayloadOptionHandler is set with WithMetricPayloadOptionHandler.
+func WithTypedMetric[P any](m Metric, query func(ctx context.Context, target string, payload P, req QueryRequest) (QueryResponse, error), options ...MetricOption) Option {
+	if t := reflect.TypeOf((*P)(nil)).Elem(); m.Payloads == nil && (t.Kind() == reflect.Struct || t.Kind() == reflect.Pointer && t.Elem().Kind() == reflect.Struct) {
+		payloads, err := PayloadsFromStruct(*new(P))
+		if err != nil {
+			panic(err)
+		}
+		var config metric
+		for _, option := range options {
+			option(&config)
+		}
+		for _, payload := range payloads {
+			if (payload.Type == "select" || payload.Type == "multi-select") && payload.Options == nil && config.payloadOptions == nil {
+				panic(fmt.Errorf("payload: %s option %q has no options and the metric has no payload option handler", payload.Type, payload.Name))
+			}
+		}
+		m.Payloads = payloads
+	}
+	handler := HandlerFunc(func(ctx context.Context, target string, req QueryRequest) (QueryResponse, error) {
+		raw, _ := req.findPayload(target)
+		payload, err := decodePayload[P](raw, target)
+		if err != nil {
+			return nil, err
+		}
+		return query(ctx, target, payload, req)
+	})
+	return WithMetric(m, handler, nil, options...)
+}
+
 // WithHandler is a convenience function to create a simple metric (i.e. one without any payload options).
 func WithHandler(target string, handler Handler) Option {
 	return WithMetric(Metric{Value: target}, handler, nil)
@@ -48,9 +98,174 @@ func WithPrometheusQueryMetrics(metrics PrometheusQueryMetrics) Option {
 	}
 }
 
+// WithPrometheusRequestMetrics adds Prometheus metrics to all the server's endpoints. The caller must register the metrics
+// with the Prometheus registry.
+//
+// See [NewDefaultPrometheusRequestMetrics] for the default implementation of Prometheus metrics.
+func WithPrometheusRequestMetrics(metrics PrometheusRequestMetrics) Option {
+	return func(s *Server) {
+		s.requestMetrics = metrics
+	}
+}
+
 // WithVariable adds a new dashboard variable to the server.
 func WithVariable(name string, v VariableFunc) Option {
+	return WithVariableHandler(name, v)
+}
+
+// WithVariableHandler adds a new dashboard variable to the server. Unlike WithVariable, the VariableHandler receives
+// the request's context, which is cancelled if Grafana aborts the request.
+func WithVariableHandler(name string, h VariableHandler) Option {
+	return func(s *Server) {
+		s.variables[name] = h
+	}
+}
+
+// WithVariablePattern adds a VariableHandler for all variable targets that match the glob pattern. In the pattern,
+// "*" matches any sequence of characters and "?" matches any single character. E.g. "hosts/*" matches "hosts/prod"
+// and "hosts/test". The text matched by each wildcard is passed to the handler in the request's Matches.
+//
+// Targets registered with WithVariable or WithVariableHandler take precedence over patterns. Patterns are tried
+// in the order in which they are added.
+func WithVariablePattern(pattern string, h VariableHandler) Option {
+	return func(s *Server) {
+		s.variablePatterns = append(s.variablePatterns, variablePattern{pattern: pattern, re: globToRegexp(pattern), handler: h})
+	}
+}
+
+// WithVariableRegexp adds a VariableHandler for all variable targets that match the regular expression. The text matched
+// by each capture group is passed to the handler in the request's Matches. E.g. the expression `^tags\((\w+)\)$`
+// matches "tags(service)", with Matches holding "service".
+//
+// Note that, unlike WithVariablePattern, the regular expression is not anchored: use ^ and $ to match the full target.
+func WithVariableRegexp(re *regexp.Regexp, h VariableHandler) Option {
+	return func(s *Server) {
+		s.variablePatterns = append(s.variablePatterns, variablePattern{pattern: re.String(), re: re, handler: h})
+	}
+}
+
+// WithDefaultVariableHandler sets the VariableHandler for all variable targets that don't match any name or pattern.
+// If no default handler is set, the server responds to such targets with http.StatusBadRequest.
+func WithDefaultVariableHandler(h VariableHandler) Option {
 	return func(s *Server) {
-		s.variables[name] = v
+		s.defaultVariable = h
+	}
+}
+
+// WithTagKeys sets the function that returns the keys available for ad-hoc filters.
+// If no function is set, the server returns http.StatusNotImplemented.
+func WithTagKeys(f TagKeysFunc) Option {
+	return func(s *Server) {
+		s.tagKeys = f
+	}
+}
+
+// WithTagValues sets the function that returns the possible values of an ad-hoc filter key.
+// If no function is set, the server returns http.StatusNotImplemented.
+func WithTagValues(f TagValuesFunc) Option {
+	return func(s *Server) {
+		s.tagValues = f
+	}
+}
+
+// WithAnnotationHandler sets the AnnotationHandler that responds to annotation requests.
+// If no handler is set, the server returns http.StatusNotImplemented.
+func WithAnnotationHandler(h AnnotationHandler) Option {
+	return func(s *Server) {
+		s.annotations = h
+	}
+}
+
+// WithMaxConcurrentTargets sets the maximum number of targets of a query request that are executed in parallel.
+// If limit is zero or negative, all targets are executed in parallel. This is the default.
+func WithMaxConcurrentTargets(limit int) Option {
+	return func(s *Server) {
+		s.maxConcurrentTargets = limit
+	}
+}
+
+// WithQueryTimeout sets the maximum time a Handler may take to respond to a query. The context passed to the Handler
+// is cancelled when the timeout expires and the query fails with ErrQueryTimeout. The default is no timeout.
+//
+// Use WithMetricTimeout to override the timeout for a single metric.
+func WithQueryTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.queryTimeout = timeout
+	}
+}
+
+// WithQueryErrorReporting reports failed query targets to Grafana, rather than only logging them.
+// If any target fails, the server responds with an HTTP error and a JSON body listing the refId and message of each
+// failed target. Handlers can return a QueryError to determine the message shown to the user.
+func WithQueryErrorReporting() Option {
+	return func(s *Server) {
+		s.reportQueryErrors = true
+	}
+}
+
+// WithPayloadValidation validates the payload of each target of a query request against the Payloads of its Metric
+// (see Metric.ValidatePayload). If any payload is invalid, the server doesn't run the query, but responds with
+// http.StatusBadRequest and a JSON body listing the invalid payload options of each target.
+func WithPayloadValidation() Option {
+	return func(s *Server) {
+		s.payloadValidation = true
+	}
+}
+
+// WithQueryMiddleware adds Middleware to the Handlers of all metrics, regardless of the order in which the metrics are added.
+// Middleware is applied in order, i.e. the first Middleware is called first. WithQueryMiddleware can be used more than once.
+func WithQueryMiddleware(middleware ...Middleware) Option {
+	return func(s *Server) {
+		s.middleware = append(s.middleware, middleware...)
+	}
+}
+
+// WithDownsampling reduces the number of data points in time series and time-indexed table responses to the
+// MaxDataPoints of the query request, using the provided method. The default is DownsampleNone.
+//
+// Use WithMetricDownsampling to override the method for a single metric.
+func WithDownsampling(method DownsampleMethod) Option {
+	return func(s *Server) {
+		s.downsampling = method
+	}
+}
+
+// WithCompression compresses the responses of the /query, /variable, /metrics and /metric-payload-options endpoints,
+// if the client accepts it. Responses smaller than minSize bytes are sent uncompressed.
+//
+// The encoders are offered in order of preference. If no encoders are provided, responses are compressed with gzip.
+func WithCompression(minSize int, encoders ...ContentEncoder) Option {
+	if len(encoders) == 0 {
+		encoders = []ContentEncoder{GzipEncoder(gzip.DefaultCompression)}
+	}
+	return func(s *Server) {
+		s.compression = compression{encoders: encoders, minSize: minSize}
+	}
+}
+
+// MetricOption configures how the server handles a metric added by WithMetric.
+type MetricOption func(*metric)
+
+// WithMetricTimeout sets the query timeout for the metric, overriding the server-wide timeout set by WithQueryTimeout.
+func WithMetricTimeout(timeout time.Duration) MetricOption {
+	return func(m *metric) {
+		m.timeout = timeout
+	}
+}
+
+// WithMetricPayloadOptionHandler sets the MetricPayloadOptionHandler of the metric, which returns the options of
+// the metric's payloads that have no Options. It overrides any MetricPayloadOptionFunc passed to WithMetric.
+// Unlike a MetricPayloadOptionFunc, the MetricPayloadOptionHandler receives the request's context.
+func WithMetricPayloadOptionHandler(h MetricPayloadOptionHandler) MetricOption {
+	return func(m *metric) {
+		m.payloadOptions = h
+	}
+}
+
+// WithMetricDownsampling sets the downsampling method for the metric, overriding the server-wide method set by WithDownsampling.
+func WithMetricDownsampling(method DownsampleMethod) MetricOption {
+	return func(m *metric) {
+		m.downsampling = method
+		m.overrideDownsampling = true
 	}
 }
@@ -75,6 +75,90 @@ namespace_subsystem_json_query_error_count{application="test",target="missing"}
 `), `namespace_subsystem_json_query_error_count`))
 }
 
+func TestWithPrometheusRequestMetrics(t *testing.T) {
+	metrics := gjson.NewDefaultPrometheusRequestMetrics("", "", "test")
+	h := gjson.NewServer(
+		gjson.WithPrometheusRequestMetrics(metrics),
+		gjson.WithHandler("foo", gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			return gjson.TimeSeriesResponse{Target: target}, nil
+		})),
+		gjson.WithVariable("bar", func(_ gjson.VariableRequest) ([]gjson.Variable, error) {
+			return []gjson.Variable{{Text: "bar", Value: "bar"}}, nil
+		}),
+		gjson.WithVariablePattern("tags(*)", gjson.VariableFunc(func(_ gjson.VariableRequest) ([]gjson.Variable, error) {
+			return nil, nil
+		})),
+		gjson.WithTagValues(func(_ context.Context, _ gjson.TagValuesRequest) ([]gjson.TagValue, error) {
+			return nil, nil
+		}),
+		gjson.WithQueryErrorReporting(),
+	)
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		wantCode int
+	}{
+		{name: "metrics", path: "/metrics", body: `{ "metric": "foo" }`, wantCode: http.StatusOK},
+		{name: "query", path: "/query", body: `{ "targets": [ { "target": "foo" }, { "target": "foo" } ] }`, wantCode: http.StatusOK},
+		{name: "query - multiple targets", path: "/query", body: `{ "targets": [ { "target": "foo" }, { "target": "missing" } ] }`, wantCode: http.StatusBadRequest},
+		{name: "query - invalid request", path: "/query", body: `{ "targets": `, wantCode: http.StatusBadRequest},
+		{name: "variable", path: "/variable", body: `{ "payload": { "target": "bar" } }`, wantCode: http.StatusOK},
+		{name: "variable - unknown target", path: "/variable", body: `{ "payload": { "target": "missing" } }`, wantCode: http.StatusBadRequest},
+		{name: "variable - pattern", path: "/variable", body: `{ "payload": { "target": "tags(service)" } }`, wantCode: http.StatusOK},
+		{name: "variable - pattern again", path: "/variable", body: `{ "payload": { "target": "tags(host)" } }`, wantCode: http.StatusOK},
+		{name: "query - unknown target", path: "/query", body: `{ "targets": [ { "target": "missing" } ] }`, wantCode: http.StatusBadRequest},
+		{name: "tag values", path: "/tag-values", body: `{ "key": "service" }`, wantCode: http.StatusOK},
+		{name: "metric payload options - unknown target", path: "/metric-payload-options", body: `{ "metric": "missing" }`, wantCode: http.StatusOK},
+		{name: "metric payload options - invalid request", path: "/metric-payload-options", body: `garbage`, wantCode: http.StatusBadRequest},
+		{name: "tag keys - not implemented", path: "/tag-keys", body: `{}`, wantCode: http.StatusNotImplemented},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "http://localhost"+tt.path, strings.NewReader(tt.body))
+			h.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantCode, w.Code)
+		})
+	}
+
+	assert.NoError(t, testutil.CollectAndCompare(metrics, strings.NewReader(`
+# HELP json_request_count Grafana JSON Data server count of requests
+# TYPE json_request_count counter
+json_request_count{application="test",code="200",endpoint="metric-payload-options",target="unknown"} 1
+json_request_count{application="test",code="200",endpoint="metrics",target="foo"} 1
+json_request_count{application="test",code="200",endpoint="query",target="foo"} 1
+json_request_count{application="test",code="200",endpoint="tag-values",target=""} 1
+json_request_count{application="test",code="200",endpoint="variable",target="bar"} 1
+json_request_count{application="test",code="200",endpoint="variable",target="tags(*)"} 2
+json_request_count{application="test",code="400",endpoint="metric-payload-options",target=""} 1
+json_request_count{application="test",code="400",endpoint="query",target=""} 2
+json_request_count{application="test",code="400",endpoint="query",target="unknown"} 1
+json_request_count{application="test",code="400",endpoint="variable",target="unknown"} 1
+json_request_count{application="test",code="501",endpoint="tag-keys",target=""} 1
+# HELP json_request_error_count Grafana JSON Data server count of failed requests
+# TYPE json_request_error_count counter
+json_request_error_count{application="test",endpoint="metric-payload-options",target=""} 1
+json_request_error_count{application="test",endpoint="query",target=""} 2
+json_request_error_count{application="test",endpoint="query",target="unknown"} 1
+json_request_error_count{application="test",endpoint="tag-keys",target=""} 1
+json_request_error_count{application="test",endpoint="variable",target="unknown"} 1
+# HELP json_request_decode_error_count Grafana JSON Data server count of requests that could not be decoded
+# TYPE json_request_decode_error_count counter
+json_request_decode_error_count{application="test",endpoint="metric-payload-options"} 1
+json_request_decode_error_count{application="test",endpoint="query"} 1
+# HELP json_request_unknown_target_count Grafana JSON Data server count of requested targets without a handler
+# TYPE json_request_unknown_target_count counter
+json_request_unknown_target_count{application="test",endpoint="metric-payload-options"} 1
+json_request_unknown_target_count{application="test",endpoint="query"} 2
+json_request_unknown_target_count{application="test",endpoint="variable"} 1
+`), "json_request_count", "json_request_error_count", "json_request_decode_error_count", "json_request_unknown_target_count"))
+	assert.Equal(t, 11, testutil.CollectAndCount(metrics, "json_request_duration_seconds"))
+	assert.Equal(t, 11, testutil.CollectAndCount(metrics, "json_response_size_bytes"))
+}
+
 func TestServer_WithVariable(t *testing.T) {
 	h := gjson.NewServer(
 		gjson.WithVariable("foo", func(_ gjson.VariableRequest) ([]gjson.Variable, error) {
@@ -151,3 +235,223 @@ func TestServer_WithVariable(t *testing.T) {
 		})
 	}
 }
+
+type ctxKey struct{}
+
+func TestWithVariableHandler(t *testing.T) {
+	h := gjson.NewServer(
+		gjson.WithVariableHandler("foo", gjson.VariableHandlerFunc(func(ctx context.Context, _ gjson.VariableRequest) ([]gjson.Variable, error) {
+			value, _ := ctx.Value(ctxKey{}).(string)
+			return []gjson.Variable{{Text: value, Value: value}}, nil
+		})),
+		gjson.WithVariableHandler("cancelled", gjson.VariableHandlerFunc(func(ctx context.Context, _ gjson.VariableRequest) ([]gjson.Variable, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})),
+	)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.WithValue(context.Background(), ctxKey{}, "bar"), http.MethodPost, "http://localhost/variable", strings.NewReader(`{ "payload": { "target": "foo" } }`))
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `[{"__text":"bar","__value":"bar"}]`+"\n", w.Body.String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/variable", strings.NewReader(`{ "payload": { "target": "cancelled" } }`))
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "variables: context canceled\n", w.Body.String())
+}
+
+func TestWithMetricPayloadOptionHandler(t *testing.T) {
+	h := gjson.NewServer(
+		gjson.WithMetric(gjson.Metric{Value: "foo"}, nil, func(_ gjson.MetricPayloadOptionsRequest) ([]gjson.MetricPayloadOption, error) {
+			return []gjson.MetricPayloadOption{{Label: "overridden", Value: "overridden"}}, nil
+		}, gjson.WithMetricPayloadOptionHandler(gjson.MetricPayloadOptionHandlerFunc(func(ctx context.Context, req gjson.MetricPayloadOptionsRequest) ([]gjson.MetricPayloadOption, error) {
+			value, _ := ctx.Value(ctxKey{}).(string)
+			return []gjson.MetricPayloadOption{{Label: req.Name, Value: value}}, nil
+		}))),
+	)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.WithValue(context.Background(), ctxKey{}, "bar"), http.MethodPost, "http://localhost/metric-payload-options", strings.NewReader(`{ "metric": "foo", "name": "option" }`))
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `[{"label":"option","value":"bar"}]`+"\n", w.Body.String())
+}
+
+func TestWithQueryTimeout(t *testing.T) {
+	metrics := gjson.NewDefaultPrometheusQueryMetrics("", "", "test")
+	h := gjson.NewServer(
+		gjson.WithPrometheusQueryMetrics(metrics),
+		gjson.WithQueryTimeout(50*time.Millisecond),
+		gjson.WithHandler("slow", gjson.HandlerFunc(func(ctx context.Context, _ string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})),
+		gjson.WithHandler("stuck", gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			time.Sleep(time.Second)
+			return gjson.TimeSeriesResponse{Target: target}, nil
+		})),
+		gjson.WithMetric(gjson.Metric{Value: "override"}, gjson.HandlerFunc(func(ctx context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				return nil, errors.New("no deadline set")
+			}
+			time.Sleep(100 * time.Millisecond)
+			return gjson.TimeSeriesResponse{Target: target}, nil
+		}), nil, gjson.WithMetricTimeout(time.Second)),
+	)
+
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{name: "slow", target: "slow", want: "[]\n"},
+		{name: "stuck", target: "stuck", want: "[]\n"},
+		{name: "override", target: "override", want: `[{"target":"override","datapoints":null}]` + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "http://localhost/query", io.NopCloser(strings.NewReader(`{ "targets": [ { "target": "`+tt.target+`" } ] }`)))
+			h.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.want, w.Body.String())
+			assert.Less(t, time.Since(start), 500*time.Millisecond)
+		})
+	}
+
+	assert.NoError(t, testutil.CollectAndCompare(metrics, strings.NewReader(`
+# HELP json_query_timeout_count Grafana JSON Data server count of timed out requests
+# TYPE json_query_timeout_count counter
+json_query_timeout_count{application="test",target="slow"} 1
+json_query_timeout_count{application="test",target="stuck"} 1
+`), `json_query_timeout_count`, `json_query_error_count`))
+}
+
+func TestWithQueryMiddleware(t *testing.T) {
+	var calls []string
+	record := func(name string) gjson.Middleware {
+		return func(next gjson.Handler) gjson.Handler {
+			return gjson.HandlerFunc(func(ctx context.Context, target string, req gjson.QueryRequest) (gjson.QueryResponse, error) {
+				calls = append(calls, name+":"+target)
+				return next.Query(ctx, target, req)
+			})
+		}
+	}
+
+	h := gjson.NewServer(
+		gjson.WithQueryMiddleware(record("first"), record("second")),
+		gjson.WithHandler("foo", gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			calls = append(calls, "handler:"+target)
+			return gjson.TimeSeriesResponse{Target: target}, nil
+		})),
+		gjson.WithQueryMiddleware(record("third")),
+	)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/query", io.NopCloser(strings.NewReader(`{ "targets": [ { "target": "foo" } ] }`)))
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"first:foo", "second:foo", "third:foo", "handler:foo"}, calls)
+}
+
+func TestWithTypedMetric(t *testing.T) {
+	type payload struct {
+		Mode     string   `json:"mode"`
+		Hosts    []string `json:"hosts"`
+		Count    int
+		Internal string `json:"-"`
+	}
+
+	h := gjson.NewServer(
+		gjson.WithQueryErrorReporting(),
+		gjson.WithTypedMetric(gjson.Metric{Value: "foo"}, func(_ context.Context, target string, p payload, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			return gjson.TableResponse{Columns: []gjson.Column{
+				{Text: "mode", Data: gjson.StringColumn{p.Mode}},
+				{Text: "hosts", Data: gjson.StringColumn{strings.Join(p.Hosts, ",")}},
+				{Text: "count", Data: gjson.IntColumn{int64(p.Count)}},
+			}}, nil
+		}, gjson.WithMetricPayloadOptionHandler(gjson.MetricPayloadOptionFunc(func(_ gjson.MetricPayloadOptionsRequest) ([]gjson.MetricPayloadOption, error) {
+			return []gjson.MetricPayloadOption{{Label: "a", Value: "a"}, {Label: "b", Value: "b"}}, nil
+		}))),
+	)
+
+	t.Run("metrics", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost/metrics", io.NopCloser(strings.NewReader(`{}`)))
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `[{"value":"foo","payloads":[{"name":"mode","type":"input"},{"name":"hosts","type":"multi-select"},{"name":"Count","type":"input"}]}]`+"\n", w.Body.String())
+	})
+
+	tests := []struct {
+		name           string
+		payload        string
+		wantStatusCode int
+		want           string
+	}{
+		{
+			name:           "payload",
+			payload:        `{ "mode": "fast", "hosts": [ "a", "b" ], "Count": 2 }`,
+			wantStatusCode: http.StatusOK,
+			want:           `[{"type":"table","columns":[{"text":"mode","type":"string"},{"text":"hosts","type":"string"},{"text":"count","type":"number"}],"rows":[["fast","a,b",2]]}]` + "\n",
+		},
+		{
+			name:           "no payload",
+			payload:        `null`,
+			wantStatusCode: http.StatusOK,
+			want:           `[{"type":"table","columns":[{"text":"mode","type":"string"},{"text":"hosts","type":"string"},{"text":"count","type":"number"}],"rows":[["","",0]]}]` + "\n",
+		},
+		{
+			name:           "invalid payload",
+			payload:        `{ "mode": 1 }`,
+			wantStatusCode: http.StatusBadRequest,
+			want:           `{"message":"A: invalid payload: mode: cannot be decoded as string","errors":[{"refId":"A","target":"foo","message":"invalid payload: mode: cannot be decoded as string","fields":[{"name":"mode","message":"cannot be decoded as string"}]}]}` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "http://localhost/query", io.NopCloser(strings.NewReader(`{ "targets": [ { "target": "foo", "refId": "A", "payload": `+tt.payload+` } ] }`)))
+			h.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantStatusCode, w.Code)
+			assert.Equal(t, tt.want, w.Body.String())
+		})
+	}
+}
+
+func TestWithTypedMetric_MissingPayloadOptions(t *testing.T) {
+	type payload struct {
+		Hosts []string `json:"hosts"`
+	}
+	query := func(_ context.Context, _ string, _ payload, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+		return nil, nil
+	}
+
+	assert.PanicsWithError(t, `payload: multi-select option "hosts" has no options and the metric has no payload option handler`, func() {
+		_ = gjson.WithTypedMetric(gjson.Metric{Value: "foo"}, query)
+	})
+
+	assert.NotPanics(t, func() {
+		_ = gjson.WithTypedMetric(gjson.Metric{Value: "foo"}, query, gjson.WithMetricPayloadOptionHandler(gjson.MetricPayloadOptionFunc(func(_ gjson.MetricPayloadOptionsRequest) ([]gjson.MetricPayloadOption, error) {
+			return nil, nil
+		})))
+	})
+
+	type inputPayload struct {
+		Hosts []string `json:"hosts" payload:"hosts,type=input"`
+	}
+	assert.NotPanics(t, func() {
+		_ = gjson.WithTypedMetric(gjson.Metric{Value: "foo"}, func(_ context.Context, _ string, _ inputPayload, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			return nil, nil
+		})
+	})
+}
@@ -0,0 +1,248 @@
+package grafana_json_server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A PayloadValidationError is returned when a target's payload doesn't match the Payloads of its Metric.
+// Fields holds the error of each invalid payload option.
+//
+// When reported to Grafana, a PayloadValidationError results in http.StatusBadRequest.
+type PayloadValidationError struct {
+	Target string
+	Fields []PayloadFieldError
+}
+
+// A PayloadFieldError describes why one payload option is invalid. If the error doesn't apply to a single option,
+// Name is blank.
+type PayloadFieldError struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+// Error returns the error of each invalid payload option.
+func (e *PayloadValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Message
+		if field.Name != "" {
+			messages[i] = field.Name + ": " + field.Message
+		}
+	}
+	return "invalid payload: " + strings.Join(messages, "; ")
+}
+
+// ValidatePayload checks that the payload of a target matches the metric's Payloads: each option in the payload must
+// be one of the metric's Payloads, select options must hold a single value and multi-select options must hold a list
+// of values. If a select or multi-select payload has Options, all values must be one of those Options.
+//
+// If the payload is invalid, ValidatePayload returns a PayloadValidationError.
+func (m Metric) ValidatePayload(payload json.RawMessage) error {
+	if len(payload) == 0 || string(payload) == "null" {
+		return nil
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return &PayloadValidationError{Target: m.Value, Fields: []PayloadFieldError{{Message: "payload is not a JSON object"}}}
+	}
+
+	var fields []PayloadFieldError
+	for name, value := range values {
+		index := slices.IndexFunc(m.Payloads, func(p MetricPayload) bool { return p.Name == name })
+		if index == -1 {
+			fields = append(fields, PayloadFieldError{Name: name, Message: "unknown payload option"})
+			continue
+		}
+		if err := m.Payloads[index].validate(value); err != nil {
+			fields = append(fields, PayloadFieldError{Name: name, Message: err.Error()})
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	slices.SortFunc(fields, func(a, b PayloadFieldError) int { return strings.Compare(a.Name, b.Name) })
+	return &PayloadValidationError{Target: m.Value, Fields: fields}
+}
+
+func (p MetricPayload) validate(value json.RawMessage) error {
+	if string(value) == "null" {
+		return nil
+	}
+
+	var values []any
+	if p.Type == "multi-select" {
+		if err := json.Unmarshal(value, &values); err != nil {
+			return errors.New("expected a list of values")
+		}
+	} else {
+		var v any
+		if err := json.Unmarshal(value, &v); err != nil {
+			return err
+		}
+		switch v.(type) {
+		case []any, map[string]any:
+			return errors.New("expected a single value")
+		}
+		values = []any{v}
+	}
+
+	// select options without Options are populated by the MetricPayloadOptionFunc, so any value is accepted.
+	if (p.Type != "select" && p.Type != "multi-select") || p.Options == nil {
+		return nil
+	}
+	for _, v := range values {
+		s := fmt.Sprint(v)
+		if !slices.ContainsFunc(p.Options, func(option MetricPayloadOption) bool { return option.Value == s }) {
+			return fmt.Errorf("%q is not a valid option", s)
+		}
+	}
+	return nil
+}
+
+// GetTypedPayload validates the target's payload against the Metric's Payloads (see Metric.ValidatePayload) and
+// unmarshals it into a value of type T.
+//
+// If the payload is invalid, or doesn't match T, GetTypedPayload returns a PayloadValidationError.
+func GetTypedPayload[T any](req QueryRequest, target string, m Metric) (T, error) {
+	var payload T
+	raw, ok := req.findPayload(target)
+	if !ok {
+		return payload, errors.New("target not found")
+	}
+	if err := m.ValidatePayload(raw); err != nil {
+		return payload, err
+	}
+	return decodePayload[T](raw, target)
+}
+
+// decodePayload unmarshals a target's raw payload into a value of type T. An empty payload results in the zero value of T.
+// If the payload doesn't match T, decodePayload returns a PayloadValidationError.
+func decodePayload[T any](raw json.RawMessage, target string) (T, error) {
+	var payload T
+	if len(raw) == 0 {
+		return payload, nil
+	}
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		field := PayloadFieldError{Message: err.Error()}
+		var typeError *json.UnmarshalTypeError
+		if errors.As(err, &typeError) {
+			field = PayloadFieldError{Name: typeError.Field, Message: "cannot be decoded as " + typeError.Type.String()}
+		}
+		return payload, &PayloadValidationError{Target: target, Fields: []PayloadFieldError{field}}
+	}
+	return payload, nil
+}
+
+// PayloadsFromStruct derives the Payloads of a Metric from the struct that the payload is decoded into. v should be
+// a struct, or a pointer to a struct. Each exported field of the struct becomes a payload option, configured by the
+// field's "payload" tag:
+//
+//	type Payload struct {
+//		Mode  string   `json:"mode" payload:"mode,type=select,label=Mode,options=Fast:fast|Slow:slow"`
+//		Hosts []string `json:"hosts" payload:"hosts,label=Hosts,width=40,placeholder=all hosts,reload"`
+//		Debug bool     `payload:"-"`
+//	}
+//
+// The first element of the tag is the name of the option. The name must match the field's JSON name, ignoring case, so
+// the payload decodes into the struct. If the tag holds no name, the JSON name is used. The remaining elements configure the
+// option:
+//
+//   - type: the option's Type. If not set, slices become "multi-select" options, fields with options become "select"
+//     options and all other fields become "input" options.
+//   - label, placeholder, width: the option's Label, Placeholder and Width.
+//   - reload: sets the option's ReloadMetric.
+//   - options: the option's Options, separated by "|". Each option is either a value, or a label and value separated by ":".
+//
+// Fields tagged with "-" are skipped. Tag values cannot contain commas.
+func PayloadsFromStruct(v any) ([]MetricPayload, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("payload: %v is not a struct", t)
+	}
+	var payloads []MetricPayload
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("payload")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		jsonName, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if jsonName == "-" {
+			continue
+		}
+		payload, err := payloadFromField(field, jsonName, tag)
+		if err != nil {
+			return nil, fmt.Errorf("payload: field %s: %w", field.Name, err)
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, nil
+}
+
+func payloadFromField(field reflect.StructField, jsonName string, tag string) (MetricPayload, error) {
+	elements := strings.Split(tag, ",")
+	payload := MetricPayload{Name: elements[0]}
+	if payload.Name == "" {
+		payload.Name = cmp.Or(jsonName, field.Name)
+	}
+	// encoding/json matches object keys to the JSON name (or, if there is none, the field name) case-insensitively,
+	// so any name that matches, ignoring case, decodes into the field.
+	if !strings.EqualFold(payload.Name, cmp.Or(jsonName, field.Name)) {
+		return MetricPayload{}, fmt.Errorf("name %q does not match the field's JSON name", payload.Name)
+	}
+
+	for _, element := range elements[1:] {
+		key, value, _ := strings.Cut(element, "=")
+		switch key {
+		case "type":
+			if !slices.Contains([]string{"select", "multi-select", "input", "textarea"}, value) {
+				return MetricPayload{}, fmt.Errorf("invalid type %q", value)
+			}
+			payload.Type = value
+		case "label":
+			payload.Label = value
+		case "placeholder":
+			payload.Placeholder = value
+		case "width":
+			width, err := strconv.Atoi(value)
+			if err != nil {
+				return MetricPayload{}, fmt.Errorf("invalid width %q", value)
+			}
+			payload.Width = width
+		case "reload":
+			payload.ReloadMetric = true
+		case "options":
+			for _, option := range strings.Split(value, "|") {
+				label, value, ok := strings.Cut(option, ":")
+				if !ok {
+					value = label
+				}
+				payload.Options = append(payload.Options, MetricPayloadOption{Label: label, Value: value})
+			}
+		default:
+			return MetricPayload{}, fmt.Errorf("invalid tag %q", element)
+		}
+	}
+
+	if payload.Type == "" {
+		switch {
+		case field.Type.Kind() == reflect.Slice:
+			payload.Type = "multi-select"
+		case payload.Options != nil:
+			payload.Type = "select"
+		default:
+			payload.Type = "input"
+		}
+	}
+	return payload, nil
+}
@@ -0,0 +1,219 @@
+package grafana_json_server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gjson "github.com/clambin/grafana-json-server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var payloadMetric = gjson.Metric{
+	Value: "foo",
+	Payloads: []gjson.MetricPayload{
+		{Name: "mode", Type: "select", Options: []gjson.MetricPayloadOption{{Label: "Fast", Value: "fast"}, {Label: "Slow", Value: "slow"}}},
+		{Name: "hosts", Type: "multi-select", Options: []gjson.MetricPayloadOption{{Value: "a"}, {Value: "b"}}},
+		{Name: "region", Type: "select"},
+		{Name: "filter", Type: "input"},
+	},
+}
+
+func TestMetric_ValidatePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		wantErr string
+	}{
+		{name: "empty"},
+		{name: "null", payload: `null`},
+		{name: "valid", payload: `{"mode":"fast","hosts":["a","b"],"region":"eu","filter":"x > 1"}`},
+		{name: "unset values", payload: `{"mode":null,"hosts":[]}`},
+		{name: "not an object", payload: `[]`, wantErr: "invalid payload: payload is not a JSON object"},
+		{name: "unknown option", payload: `{"bar":"1"}`, wantErr: "invalid payload: bar: unknown payload option"},
+		{name: "invalid select", payload: `{"mode":"medium"}`, wantErr: `invalid payload: mode: "medium" is not a valid option`},
+		{name: "invalid multi-select", payload: `{"hosts":["a","c"]}`, wantErr: `invalid payload: hosts: "c" is not a valid option`},
+		{name: "select with multiple values", payload: `{"mode":["fast"]}`, wantErr: "invalid payload: mode: expected a single value"},
+		{name: "multi-select with single value", payload: `{"hosts":"a"}`, wantErr: "invalid payload: hosts: expected a list of values"},
+		{name: "input with object", payload: `{"filter":{}}`, wantErr: "invalid payload: filter: expected a single value"},
+		{
+			name:    "multiple errors",
+			payload: `{"mode":"medium","bar":"1"}`,
+			wantErr: `invalid payload: bar: unknown payload option; mode: "medium" is not a valid option`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := payloadMetric.ValidatePayload(json.RawMessage(tt.payload))
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.wantErr)
+			var validationError *gjson.PayloadValidationError
+			assert.ErrorAs(t, err, &validationError)
+		})
+	}
+}
+
+func TestGetTypedPayload(t *testing.T) {
+	type payload struct {
+		Mode   string   `json:"mode"`
+		Hosts  []string `json:"hosts"`
+		Filter int      `json:"filter"`
+	}
+
+	tests := []struct {
+		name    string
+		payload string
+		want    payload
+		wantErr string
+	}{
+		{name: "valid", payload: `{"mode":"fast","hosts":["a"]}`, want: payload{Mode: "fast", Hosts: []string{"a"}}},
+		{name: "no payload", want: payload{}},
+		{name: "invalid", payload: `{"mode":"medium"}`, wantErr: `invalid payload: mode: "medium" is not a valid option`},
+		{name: "wrong type", payload: `{"filter":"x"}`, wantErr: `invalid payload: filter: cannot be decoded as int`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := gjson.QueryRequest{Targets: []gjson.QueryRequestTarget{{Target: "foo", Payload: json.RawMessage(tt.payload)}}}
+			got, err := gjson.GetTypedPayload[payload](req, "foo", payloadMetric)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := gjson.GetTypedPayload[payload](gjson.QueryRequest{}, "foo", payloadMetric)
+	assert.EqualError(t, err, "target not found")
+}
+
+func TestServer_WithPayloadValidation(t *testing.T) {
+	var calls int
+	h := gjson.NewServer(
+		gjson.WithPayloadValidation(),
+		gjson.WithMetric(payloadMetric, gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			calls++
+			return gjson.TimeSeriesResponse{Target: target}, nil
+		}), nil),
+	)
+
+	testCases := []struct {
+		name           string
+		queryRequest   string
+		wantStatusCode int
+		want           string
+		wantCalls      int
+	}{
+		{
+			name:           "valid",
+			queryRequest:   `{ "targets": [ { "target": "foo", "refId": "A", "payload": { "mode": "slow" } } ] }`,
+			wantStatusCode: http.StatusOK,
+			want: `[{"target":"foo","datapoints":null}]
+`,
+			wantCalls: 1,
+		},
+		{
+			name:           "invalid",
+			queryRequest:   `{ "targets": [ { "target": "foo", "refId": "A", "payload": { "mode": "slow" } }, { "target": "foo", "refId": "B", "payload": { "mode": "medium", "bar": 1 } } ] }`,
+			wantStatusCode: http.StatusBadRequest,
+			want: `{"message":"B: invalid payload: bar: unknown payload option; mode: \"medium\" is not a valid option","errors":[{"refId":"B","target":"foo","message":"invalid payload: bar: unknown payload option; mode: \"medium\" is not a valid option","fields":[{"name":"bar","message":"unknown payload option"},{"name":"mode","message":"\"medium\" is not a valid option"}]}]}
+`,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = 0
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "http://localhost/query", bytes.NewBufferString(tt.queryRequest))
+			h.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.wantStatusCode, w.Code)
+			assert.Equal(t, tt.want, w.Body.String())
+			assert.Equal(t, tt.wantCalls, calls)
+		})
+	}
+}
+
+func TestPayloadsFromStruct(t *testing.T) {
+	type payload struct {
+		Mode     string   `json:"mode" payload:"mode,type=select,label=Mode,options=Fast:fast|Slow:slow"`
+		Hosts    []string `json:"hosts" payload:",label=Hosts,width=40,placeholder=all hosts,reload"`
+		Region   string   `payload:"region,options=eu|us"`
+		Filter   string   `payload:",type=textarea"`
+		Debug    bool     `payload:"-"`
+		Internal string   `json:"-"`
+		Limit    int      `json:"limit" payload:"Limit"`
+	}
+
+	got, err := gjson.PayloadsFromStruct(&payload{})
+	require.NoError(t, err)
+	assert.Equal(t, []gjson.MetricPayload{
+		{Name: "mode", Type: "select", Label: "Mode", Options: []gjson.MetricPayloadOption{{Label: "Fast", Value: "fast"}, {Label: "Slow", Value: "slow"}}},
+		{Name: "hosts", Type: "multi-select", Label: "Hosts", Width: 40, Placeholder: "all hosts", ReloadMetric: true},
+		{Name: "region", Type: "select", Options: []gjson.MetricPayloadOption{{Label: "eu", Value: "eu"}, {Label: "us", Value: "us"}}},
+		{Name: "Filter", Type: "textarea"},
+		{Name: "Limit", Type: "input"},
+	}, got)
+
+	// option names that differ in case from the JSON name are validated and decoded
+	body := json.RawMessage(`{"Limit":10}`)
+	require.NoError(t, gjson.Metric{Payloads: got}.ValidatePayload(body))
+	var p payload
+	require.NoError(t, json.Unmarshal(body, &p))
+	assert.Equal(t, 10, p.Limit)
+
+	tests := []struct {
+		name    string
+		v       any
+		wantErr string
+	}{
+		{name: "not a struct", v: "foo", wantErr: "payload: string is not a struct"},
+		{name: "nil", v: nil, wantErr: "payload: <nil> is not a struct"},
+		{
+			name: "name mismatch",
+			v: struct {
+				Mode string `json:"mode" payload:"type"`
+			}{},
+			wantErr: `payload: field Mode: name "type" does not match the field's JSON name`,
+		},
+		{
+			name: "invalid type",
+			v: struct {
+				Mode string `payload:",type=radio"`
+			}{},
+			wantErr: `payload: field Mode: invalid type "radio"`,
+		},
+		{
+			name: "invalid width",
+			v: struct {
+				Mode string `payload:",width=wide"`
+			}{},
+			wantErr: `payload: field Mode: invalid width "wide"`,
+		},
+		{
+			name: "invalid tag",
+			v: struct {
+				Mode string `payload:",colour=red"`
+			}{},
+			wantErr: `payload: field Mode: invalid tag "colour=red"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := gjson.PayloadsFromStruct(tt.v)
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
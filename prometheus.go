@@ -1,25 +1,43 @@
 package grafana_json_server
 
 import (
+	"context"
+	"errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// PrometheusQueryMetrics records the duration and result of each query.
 type PrometheusQueryMetrics interface {
 	Measure(target string, duration time.Duration, err error)
 	prometheus.Collector
 }
 
+// A PanicRecorder counts panics outside of query Handlers, i.e. in VariableHandlers and MetricPayloadOptionHandlers.
+// If the PrometheusQueryMetrics passed to WithPrometheusQueryMetrics implements PanicRecorder, the server uses it
+// to record these panics. Panics in Handlers are passed to Measure as a PanicError.
+type PanicRecorder interface {
+	RecordPanic(endpoint string, target string)
+}
+
 var _ PrometheusQueryMetrics = &defaultPrometheusQueryMetrics{}
+var _ PanicRecorder = &defaultPrometheusQueryMetrics{}
 
 type defaultPrometheusQueryMetrics struct {
 	duration *prometheus.SummaryVec
 	errors   *prometheus.CounterVec
+	timeouts *prometheus.CounterVec
+	panics   *prometheus.CounterVec
 }
 
-// NewDefaultPrometheusQueryMetrics returns the default PrometheusQueryMetrics implementation. It created two Prometheus metrics:
+// NewDefaultPrometheusQueryMetrics returns the default PrometheusQueryMetrics implementation. It created four Prometheus metrics:
 //   - json_query_duration_seconds records the duration of each query
 //   - json_query_error_count counts the total number of errors executing a query
+//   - json_query_timeout_count counts the total number of queries that timed out. These are not counted as errors.
+//   - json_panic_count counts the total number of panics, with the endpoint as a label "endpoint". Panics in queries are also counted as errors.
 //
 // If namespace and/or subsystem are not blank, they are prepended to the metric name.
 // Application is added as a label "application".
@@ -40,22 +58,263 @@ func NewDefaultPrometheusQueryMetrics(namespace, subsystem, application string)
 			Help:        "Grafana JSON Data server count of failed requests",
 			ConstLabels: prometheus.Labels{"application": application},
 		}, []string{"target"}),
+		timeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "json_query_timeout_count",
+			Help:        "Grafana JSON Data server count of timed out requests",
+			ConstLabels: prometheus.Labels{"application": application},
+		}, []string{"target"}),
+		panics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "json_panic_count",
+			Help:        "Grafana JSON Data server count of recovered panics",
+			ConstLabels: prometheus.Labels{"application": application},
+		}, []string{"endpoint", "target"}),
 	}
 }
 
 func (m defaultPrometheusQueryMetrics) Measure(target string, duration time.Duration, err error) {
-	if err != nil {
+	switch {
+	case errors.Is(err, ErrQueryTimeout):
+		m.timeouts.WithLabelValues(target).Add(1)
+	case err != nil:
 		m.errors.WithLabelValues(target).Add(1)
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			m.RecordPanic("query", target)
+		}
 	}
 	m.duration.WithLabelValues(target).Observe(duration.Seconds())
 }
 
+func (m defaultPrometheusQueryMetrics) RecordPanic(endpoint string, target string) {
+	m.panics.WithLabelValues(endpoint, target).Add(1)
+}
+
 func (m defaultPrometheusQueryMetrics) Describe(descs chan<- *prometheus.Desc) {
 	m.duration.Describe(descs)
 	m.errors.Describe(descs)
+	m.timeouts.Describe(descs)
+	m.panics.Describe(descs)
 }
 
 func (m defaultPrometheusQueryMetrics) Collect(metrics chan<- prometheus.Metric) {
 	m.duration.Collect(metrics)
 	m.errors.Collect(metrics)
+	m.timeouts.Collect(metrics)
+	m.panics.Collect(metrics)
+}
+
+// PrometheusRequestMetrics records each request handled by the server, for all endpoints.
+type PrometheusRequestMetrics interface {
+	MeasureRequest(m RequestMeasurement)
+	prometheus.Collector
+}
+
+// RequestMeasurement describes a request handled by the server.
+type RequestMeasurement struct {
+	// Endpoint is the path of the request, without the leading "/", e.g. "query" or "variable".
+	Endpoint string
+	// Target is the metric or variable that the request was for. To keep clients from creating an unlimited number of
+	// time series, Target only holds registered names: a variable routed by WithVariablePattern or WithVariableRegexp
+	// holds the pattern, a variable routed to the default handler holds "default" and a target without a handler holds
+	// "unknown". Target is blank for other endpoints and for queries for more than one metric.
+	Target string
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Duration is the time it took to handle the request.
+	Duration time.Duration
+	// ResponseSize is the size of the response body, in bytes, as sent to the client, i.e. after compression.
+	ResponseSize int
+	// DecodeFailed is true if the request body could not be decoded.
+	DecodeFailed bool
+	// UnknownTargets is the number of targets in the request that the server has no handler for.
+	UnknownTargets int
+}
+
+const (
+	// unknownTargetLabel is the target of a RequestMeasurement for a target that the server has no handler for.
+	unknownTargetLabel = "unknown"
+	// defaultVariableLabel is the target of a RequestMeasurement for a variable routed to the default handler.
+	defaultVariableLabel = "default"
+)
+
+var _ PrometheusRequestMetrics = &defaultPrometheusRequestMetrics{}
+
+type defaultPrometheusRequestMetrics struct {
+	requests       *prometheus.CounterVec
+	duration       *prometheus.HistogramVec
+	errors         *prometheus.CounterVec
+	responseSize   *prometheus.HistogramVec
+	decodeFailures *prometheus.CounterVec
+	unknownTargets *prometheus.CounterVec
+}
+
+// NewDefaultPrometheusRequestMetrics returns the default PrometheusRequestMetrics implementation. It creates six Prometheus metrics:
+//   - json_request_count counts the total number of requests, with the HTTP status code as a label "code"
+//   - json_request_duration_seconds records the duration of each request
+//   - json_request_error_count counts the total number of requests that returned an HTTP status code of 400 or higher
+//   - json_response_size_bytes records the size of each response body
+//   - json_request_decode_error_count counts the total number of requests whose body could not be decoded
+//   - json_request_unknown_target_count counts the total number of targets that the server has no handler for
+//
+// If namespace and/or subsystem are not blank, they are prepended to the metric name.
+// Application is added as a label "application".
+// The endpoint is added as a label "endpoint". Except for the last two metrics, the request's target is added as a label "target".
+// See RequestMeasurement for the values of the target label.
+func NewDefaultPrometheusRequestMetrics(namespace, subsystem, application string) PrometheusRequestMetrics {
+	return defaultPrometheusRequestMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "json_request_count",
+			Help:        "Grafana JSON Data server count of requests",
+			ConstLabels: prometheus.Labels{"application": application},
+		}, []string{"endpoint", "target", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "json_request_duration_seconds",
+			Help:        "Grafana JSON Data server duration of requests in seconds",
+			ConstLabels: prometheus.Labels{"application": application},
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"endpoint", "target"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "json_request_error_count",
+			Help:        "Grafana JSON Data server count of failed requests",
+			ConstLabels: prometheus.Labels{"application": application},
+		}, []string{"endpoint", "target"}),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "json_response_size_bytes",
+			Help:        "Grafana JSON Data server size of responses in bytes",
+			ConstLabels: prometheus.Labels{"application": application},
+			Buckets:     prometheus.ExponentialBuckets(256, 4, 8),
+		}, []string{"endpoint", "target"}),
+		decodeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "json_request_decode_error_count",
+			Help:        "Grafana JSON Data server count of requests that could not be decoded",
+			ConstLabels: prometheus.Labels{"application": application},
+		}, []string{"endpoint"}),
+		unknownTargets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "json_request_unknown_target_count",
+			Help:        "Grafana JSON Data server count of requested targets without a handler",
+			ConstLabels: prometheus.Labels{"application": application},
+		}, []string{"endpoint"}),
+	}
+}
+
+func (m defaultPrometheusRequestMetrics) MeasureRequest(r RequestMeasurement) {
+	m.requests.WithLabelValues(r.Endpoint, r.Target, strconv.Itoa(r.StatusCode)).Add(1)
+	m.duration.WithLabelValues(r.Endpoint, r.Target).Observe(r.Duration.Seconds())
+	if r.StatusCode >= http.StatusBadRequest {
+		m.errors.WithLabelValues(r.Endpoint, r.Target).Add(1)
+	}
+	m.responseSize.WithLabelValues(r.Endpoint, r.Target).Observe(float64(r.ResponseSize))
+	if r.DecodeFailed {
+		m.decodeFailures.WithLabelValues(r.Endpoint).Add(1)
+	}
+	if r.UnknownTargets > 0 {
+		m.unknownTargets.WithLabelValues(r.Endpoint).Add(float64(r.UnknownTargets))
+	}
+}
+
+func (m defaultPrometheusRequestMetrics) Describe(descs chan<- *prometheus.Desc) {
+	m.requests.Describe(descs)
+	m.duration.Describe(descs)
+	m.errors.Describe(descs)
+	m.responseSize.Describe(descs)
+	m.decodeFailures.Describe(descs)
+	m.unknownTargets.Describe(descs)
+}
+
+func (m defaultPrometheusRequestMetrics) Collect(metrics chan<- prometheus.Metric) {
+	m.requests.Collect(metrics)
+	m.duration.Collect(metrics)
+	m.errors.Collect(metrics)
+	m.responseSize.Collect(metrics)
+	m.decodeFailures.Collect(metrics)
+	m.unknownTargets.Collect(metrics)
+}
+
+// instrument returns a http.HandlerFunc that measures each request of the handler and passes it to the server's
+// PrometheusRequestMetrics. The handler reports the request's target, decode failures and unknown targets through
+// the requestInfo in the request's context.
+func (s Server) instrument(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var info requestInfo
+		mw := measuringResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(&mw, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, &info)))
+		info.lock.Lock()
+		defer info.lock.Unlock()
+		s.requestMetrics.MeasureRequest(RequestMeasurement{
+			Endpoint:       endpoint,
+			Target:         info.target,
+			StatusCode:     mw.status,
+			Duration:       time.Since(start),
+			ResponseSize:   mw.size,
+			DecodeFailed:   info.decodeFailed,
+			UnknownTargets: info.unknownTargets,
+		})
+	}
+}
+
+type requestInfoKey struct{}
+
+// requestInfo holds the details of a request that are only known to the endpoint's handler. Queries run in parallel,
+// so access is guarded by a lock.
+type requestInfo struct {
+	lock           sync.Mutex
+	target         string
+	decodeFailed   bool
+	unknownTargets int
+}
+
+// updateRequestInfo calls f with the requestInfo in the context, if there is one.
+func updateRequestInfo(ctx context.Context, f func(info *requestInfo)) {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.lock.Lock()
+		defer info.lock.Unlock()
+		f(info)
+	}
+}
+
+func setRequestTarget(ctx context.Context, target string) {
+	updateRequestInfo(ctx, func(info *requestInfo) { info.target = target })
+}
+
+func addUnknownTarget(ctx context.Context) {
+	updateRequestInfo(ctx, func(info *requestInfo) { info.unknownTargets++ })
+}
+
+// measuringResponseWriter records the status code and the size of the response.
+type measuringResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	size        int
+	wroteHeader bool
+}
+
+func (w *measuringResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *measuringResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
 }
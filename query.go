@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	jsoniter "github.com/json-iterator/go"
 	"strconv"
 	"time"
@@ -39,6 +40,9 @@ type QueryRequest struct {
 	MaxDataPoints int                  `json:"maxDataPoints"`
 	LiveStreaming bool                 `json:"liveStreaming"`
 	AdhocFilters  []interface{}        `json:"adhocFilters"`
+	// Target is the target that the Handler is called for. The server sets Target before calling the Handler.
+	// Unlike the Targets field, Target can't be confused with another target of the same metric, with a different payload.
+	Target QueryRequestTarget `json:"-"`
 }
 
 // QueryRequestTarget is one target in the QueryRequest structure. The main interesting fields are the Target, which is
@@ -57,6 +61,14 @@ type QueryRequestTarget struct {
 	Type       string          `json:"type"` // TODO: is this really present?
 }
 
+// GetPayload unmarshals the target's raw payload into a provided payload.
+func (t QueryRequestTarget) GetPayload(payload any) error {
+	if t.Payload == nil {
+		return errors.New("no payload found")
+	}
+	return json.Unmarshal(t.Payload, payload)
+}
+
 // Range is the time range of the QueryRequest.
 type Range struct {
 	From time.Time `json:"from"`
@@ -71,16 +83,32 @@ type RawRange struct {
 }
 
 // GetPayload unmarshals the target's raw payload into a provided payload.
+//
+// If the request holds several targets for the same metric, GetPayload returns the payload of the first one. Inside
+// a Handler, use req.Target.GetPayload to get the payload of the target being queried.
 func (r QueryRequest) GetPayload(target string, payload any) error {
+	raw, ok := r.findPayload(target)
+	if !ok {
+		return errors.New("target not found")
+	}
+	if raw == nil {
+		return errors.New("no payload found")
+	}
+	return json.Unmarshal(raw, payload)
+}
+
+// findPayload returns the raw payload of the target. If the target is not part of the request, it returns false.
+// If the request's Target is set, and matches the target, its payload is returned.
+func (r QueryRequest) findPayload(target string) (json.RawMessage, bool) {
+	if r.Target.Target == target {
+		return r.Target.Payload, true
+	}
 	for _, t := range r.Targets {
 		if t.Target == target {
-			if t.Payload == nil {
-				return errors.New("no payload found")
-			}
-			return json.Unmarshal(t.Payload, payload)
+			return t.Payload, true
 		}
 	}
-	return errors.New("target not found")
+	return nil, false
 }
 
 // A ScopedVar holds the value of a dashboard variable and is sent to the server as part of the QueryRequest.
@@ -97,7 +125,8 @@ func (r QueryRequest) GetScopedVars(vars any) error {
 	return json.Unmarshal(r.ScopedVars, vars)
 }
 
-// QueryResponse is the output of the query function.  Both TimeSeriesResponse and TableResponse implement this interface.
+// QueryResponse is the output of the query function.  TimeSeriesResponse, MultiTimeSeriesResponse, TableResponse and
+// DataFrameResponse implement this interface.
 type QueryResponse interface {
 	json.Marshaler
 }
@@ -117,6 +146,17 @@ func (r TimeSeriesResponse) MarshalJSON() ([]byte, error) {
 	return jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(v2)
 }
 
+var _ QueryResponse = MultiTimeSeriesResponse{}
+
+// MultiTimeSeriesResponse allows a single target to return multiple time series, e.g. one per selected option
+// in a multi-select payload. The server sends each TimeSeriesResponse as a separate entry in the query response.
+type MultiTimeSeriesResponse []TimeSeriesResponse
+
+// MarshalJSON converts a MultiTimeSeriesResponse to JSON.
+func (r MultiTimeSeriesResponse) MarshalJSON() ([]byte, error) {
+	return jsoniter.ConfigCompatibleWithStandardLibrary.Marshal([]TimeSeriesResponse(r))
+}
+
 // DataPoint contains one entry of a TimeSeriesResponse.
 type DataPoint struct {
 	Timestamp time.Time
@@ -148,8 +188,8 @@ type TableResponse struct {
 }
 
 // Column is a column returned by a table query.  Text holds the column's header,
-// Data holds the slice of values and should be a TimeColumn, a StringColumn
-// or a NumberColumn.
+// Data holds the slice of values and should be a TimeColumn, a StringColumn, a NumberColumn,
+// an IntColumn, a BoolColumn or one of their Nullable variants.
 type Column struct {
 	Text string
 	Data any
@@ -164,6 +204,28 @@ type StringColumn []string
 // NumberColumn holds a slice of float64 values (one per row).
 type NumberColumn []float64
 
+// IntColumn holds a slice of int64 values (one per row).
+type IntColumn []int64
+
+// BoolColumn holds a slice of bool values (one per row).
+type BoolColumn []bool
+
+// NullableTimeColumn holds a slice of time.Time values (one per row). A nil entry is sent as null.
+type NullableTimeColumn []*time.Time
+
+// NullableStringColumn holds a slice of string values (one per row). A nil entry is sent as null.
+type NullableStringColumn []*string
+
+// NullableNumberColumn holds a slice of float64 values (one per row). A nil entry is sent as null,
+// which Grafana shows as a gap, rather than a zero value.
+type NullableNumberColumn []*float64
+
+// NullableIntColumn holds a slice of int64 values (one per row). A nil entry is sent as null.
+type NullableIntColumn []*int64
+
+// NullableBoolColumn holds a slice of bool values (one per row). A nil entry is sent as null.
+type NullableBoolColumn []*bool
+
 type tableResponse struct {
 	Type    string                `json:"type"`
 	Columns []tableResponseColumn `json:"columns"`
@@ -200,16 +262,9 @@ func (t TableResponse) getColumnDetails() ([]string, int, error) {
 
 	for i, entry := range t.Columns {
 		var dataCount int
-		switch data := entry.Data.(type) {
-		case TimeColumn:
-			colTypes[i] = "time"
-			dataCount = len(data)
-		case StringColumn:
-			colTypes[i] = "string"
-			dataCount = len(data)
-		case NumberColumn:
-			colTypes[i] = "number"
-			dataCount = len(data)
+		var ok bool
+		if colTypes[i], dataCount, ok = columnType(entry.Data); !ok {
+			return nil, 0, fmt.Errorf("error building table query output: column %q has unsupported type %T", entry.Text, entry.Data)
 		}
 
 		if rowCount == 0 {
@@ -223,6 +278,35 @@ func (t TableResponse) getColumnDetails() ([]string, int, error) {
 	return colTypes, rowCount, nil
 }
 
+// columnType returns the Grafana type of the column data and its number of rows. If data is not a supported column type,
+// columnType returns false.
+func columnType(data any) (string, int, bool) {
+	switch data := data.(type) {
+	case TimeColumn:
+		return "time", len(data), true
+	case StringColumn:
+		return "string", len(data), true
+	case NumberColumn:
+		return "number", len(data), true
+	case IntColumn:
+		return "number", len(data), true
+	case BoolColumn:
+		return "boolean", len(data), true
+	case NullableTimeColumn:
+		return "time", len(data), true
+	case NullableStringColumn:
+		return "string", len(data), true
+	case NullableNumberColumn:
+		return "number", len(data), true
+	case NullableIntColumn:
+		return "number", len(data), true
+	case NullableBoolColumn:
+		return "boolean", len(data), true
+	default:
+		return "", 0, false
+	}
+}
+
 func (t TableResponse) buildColumns(colTypes []string) []tableResponseColumn {
 	columns := make([]tableResponseColumn, len(colTypes))
 	for index, colType := range colTypes {
@@ -248,6 +332,20 @@ func (t TableResponse) buildRows(rowCount int) []tableResponseRow {
 			fillColumn(rows, column, data)
 		case NumberColumn:
 			fillColumn(rows, column, data)
+		case IntColumn:
+			fillColumn(rows, column, data)
+		case BoolColumn:
+			fillColumn(rows, column, data)
+		case NullableTimeColumn:
+			fillColumn(rows, column, data)
+		case NullableStringColumn:
+			fillColumn(rows, column, data)
+		case NullableNumberColumn:
+			fillColumn(rows, column, data)
+		case NullableIntColumn:
+			fillColumn(rows, column, data)
+		case NullableBoolColumn:
+			fillColumn(rows, column, data)
 		}
 	}
 
@@ -89,6 +89,88 @@ func TestQueryResponse_Marshal(t *testing.T) {
 			},
 			wantErr: assert.NoError,
 		},
+		{
+			name: "table - extended types",
+			payload: gjson.TableResponse{
+				Columns: []gjson.Column{
+					{Text: "Time", Data: gjson.NullableTimeColumn{ptr(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)), nil}},
+					{Text: "Label", Data: gjson.NullableStringColumn{nil, ptr("bar")}},
+					{Text: "Count", Data: gjson.IntColumn{1, 2}},
+					{Text: "Up", Data: gjson.BoolColumn{true, false}},
+					{Text: "Series A", Data: gjson.NullableNumberColumn{ptr(42.0), nil}},
+					{Text: "Series B", Data: gjson.NullableIntColumn{nil, ptr(int64(10))}},
+					{Text: "Healthy", Data: gjson.NullableBoolColumn{ptr(true), nil}},
+				},
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			name: "table - unsupported type",
+			payload: gjson.TableResponse{
+				Columns: []gjson.Column{
+					{Text: "Time", Data: gjson.TimeColumn{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}},
+					{Text: "Value", Data: []int{1}},
+				},
+			},
+			wantErr: assert.Error,
+		},
+		{
+			name: "dataframe - nullable",
+			payload: gjson.DataFrameResponse{
+				Fields: []gjson.Field{
+					{Name: "Time", Values: gjson.NullableTimeColumn{ptr(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)), nil}},
+					{Name: "Value", Values: gjson.NullableNumberColumn{nil, ptr(1.5)}},
+				},
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			name: "dataframe",
+			payload: gjson.DataFrameResponse{
+				Name:  "cpu",
+				RefID: "A",
+				Fields: []gjson.Field{
+					{Name: "Time", Values: gjson.TimeColumn{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 1, 1, 0, 1, 0, 0, time.UTC)}},
+					{Name: "Host", Values: gjson.StringColumn{"foo", "bar"}},
+					{
+						Name:   "Usage",
+						Labels: map[string]string{"mode": "user"},
+						Config: &gjson.FieldConfig{
+							DisplayName: "CPU usage",
+							Unit:        "percent",
+							Thresholds: &gjson.Thresholds{
+								Mode: gjson.ThresholdsModeAbsolute,
+								Steps: []gjson.Threshold{
+									{Color: "green"},
+									{Value: ptr(80.0), Color: "red"},
+								},
+							},
+						},
+						Values: gjson.NumberColumn{42, 85.5},
+					},
+				},
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			name: "dataframe - invalid",
+			payload: gjson.DataFrameResponse{
+				Fields: []gjson.Field{
+					{Name: "Time", Values: gjson.TimeColumn{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}},
+					{Name: "Value", Values: gjson.NumberColumn{1, 2}},
+				},
+			},
+			wantErr: assert.Error,
+		},
+		{
+			name: "dataframe - unsupported type",
+			payload: gjson.DataFrameResponse{
+				Fields: []gjson.Field{
+					{Name: "Value", Values: []int{1, 2}},
+				},
+			},
+			wantErr: assert.Error,
+		},
 		{
 			name:    "combined",
 			payload: makeCombinedQueryResponse(),
@@ -141,6 +223,10 @@ func TestQueryResponse_Marshal(t *testing.T) {
 	}
 }
 
+func ptr[T any](v T) *T {
+	return &v
+}
+
 type combinedResponse struct {
 	responses []interface{}
 }
@@ -287,6 +373,28 @@ func TestQueryRequest_GetPayload(t *testing.T) {
 	}
 }
 
+func TestQueryRequestTarget_GetPayload(t *testing.T) {
+	req := gjson.QueryRequest{
+		Targets: []gjson.QueryRequestTarget{
+			{RefID: "A", Target: "foo", Payload: json.RawMessage(`{ "bar": "A" }`)},
+			{RefID: "B", Target: "foo", Payload: json.RawMessage(`{ "bar": "B" }`)},
+		},
+	}
+	req.Target = req.Targets[1]
+
+	var payload struct {
+		Bar string
+	}
+	assert.NoError(t, req.Target.GetPayload(&payload))
+	assert.Equal(t, "B", payload.Bar)
+
+	// GetPayload returns the payload of the request's Target
+	assert.NoError(t, req.GetPayload("foo", &payload))
+	assert.Equal(t, "B", payload.Bar)
+
+	assert.Error(t, gjson.QueryRequestTarget{}.GetPayload(&payload))
+}
+
 func TestQueryRequest_GetScopedVars(t *testing.T) {
 	req := gjson.QueryRequest{
 		ScopedVars: json.RawMessage(`
@@ -3,33 +3,54 @@ package grafana_json_server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"runtime/debug"
+	"sync"
 	"time"
 )
 
 // The Server structure implements a JSON API server compatible with the JSON API Grafana datasource.
 type Server struct {
-	metricConfigs     map[string]metric
-	variables         map[string]VariableFunc
-	logger            *slog.Logger
-	prometheusMetrics PrometheusQueryMetrics
+	metricConfigs        map[string]metric
+	variables            map[string]VariableHandler
+	variablePatterns     []variablePattern
+	defaultVariable      VariableHandler
+	maxConcurrentTargets int
+	queryTimeout         time.Duration
+	reportQueryErrors    bool
+	payloadValidation    bool
+	middleware           []Middleware
+	downsampling         DownsampleMethod
+	tagKeys              TagKeysFunc
+	tagValues            TagValuesFunc
+	annotations          AnnotationHandler
+	compression          compression
+	logger               *slog.Logger
+	prometheusMetrics    PrometheusQueryMetrics
+	requestMetrics       PrometheusRequestMetrics
 	http.Handler
 }
 
 type metric struct {
 	Metric
-	MetricPayloadOptionFunc
 	Handler
+	payloadOptions MetricPayloadOptionHandler
+	timeout        time.Duration
+	// downsampling overrides the server's downsampling method, if overrideDownsampling is true
+	downsampling         DownsampleMethod
+	overrideDownsampling bool
 }
 
 // NewServer returns a new JSON API server, configured as per the provided Option items.
 func NewServer(options ...Option) *Server {
 	s := Server{
 		metricConfigs:     make(map[string]metric),
-		variables:         make(map[string]VariableFunc),
+		variables:         make(map[string]VariableHandler),
 		prometheusMetrics: NewDefaultPrometheusQueryMetrics("", "", "grafana-json-server"),
+		requestMetrics:    NewDefaultPrometheusRequestMetrics("", "", "grafana-json-server"),
 		logger:            slog.Default(),
 	}
 
@@ -40,12 +61,20 @@ func NewServer(options ...Option) *Server {
 		option(&s)
 	}
 
-	h.HandleFunc("POST /metrics", s.metrics)
-	h.HandleFunc("POST /metric-payload-options", s.metricsPayloadOptions)
-	h.HandleFunc("POST /variable", s.variable)
-	h.HandleFunc("POST /tag-keys", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNotImplemented) })
-	h.HandleFunc("POST /tag-values", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNotImplemented) })
-	h.HandleFunc("POST /query", s.query)
+	for name, config := range s.metricConfigs {
+		if config.Handler != nil {
+			config.Handler = chain(config.Handler, s.middleware)
+			s.metricConfigs[name] = config
+		}
+	}
+
+	h.HandleFunc("POST /metrics", s.instrument("metrics", s.compression.compress(s.metrics)))
+	h.HandleFunc("POST /metric-payload-options", s.instrument("metric-payload-options", s.compression.compress(s.metricsPayloadOptions)))
+	h.HandleFunc("POST /variable", s.instrument("variable", s.compression.compress(s.variable)))
+	h.HandleFunc("POST /tag-keys", s.instrument("tag-keys", s.tagKeysHandler))
+	h.HandleFunc("POST /tag-values", s.instrument("tag-values", s.tagValuesHandler))
+	h.HandleFunc("POST /query", s.instrument("query", s.compression.compress(s.query)))
+	h.HandleFunc("POST /annotations", s.instrument("annotations", s.annotationsHandler))
 	h.HandleFunc("/", ok)
 
 	return &s
@@ -73,6 +102,7 @@ func (s Server) metrics(w http.ResponseWriter, r *http.Request) {
 		s.logger.Error("invalid request", "err", err)
 		return
 	}
+	setRequestTarget(r.Context(), s.metricLabel(queryRequest.Metric))
 
 	metrics := make([]Metric, 0, len(s.metricConfigs))
 	for _, config := range s.metricConfigs {
@@ -89,25 +119,33 @@ func (s Server) metricsPayloadOptions(w http.ResponseWriter, r *http.Request) {
 	req, err := parseRequest[MetricPayloadOptionsRequest](w, r)
 	if err != nil {
 		s.logger.Error("invalid request", "err", err)
+		return
 	}
 
+	setRequestTarget(r.Context(), s.metricLabel(req.Metric))
 	dataSource, ok := s.metricConfigs[req.Metric]
 	if !ok {
+		addUnknownTarget(r.Context())
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("[]\n"))
 		return
 	}
 
-	if dataSource.MetricPayloadOptionFunc == nil {
+	if dataSource.payloadOptions == nil {
 		w.Header().Set("Content-Type", "plain/text")
 		http.Error(w, "invalid request: target does not have a metric payload option function", http.StatusInternalServerError)
 		return
 	}
 
-	options, err := dataSource.MetricPayloadOptionFunc(req)
+	options, err := safeCall(func() ([]MetricPayloadOption, error) {
+		return dataSource.payloadOptions.PayloadOptions(r.Context(), req)
+	})
 	if err != nil {
+		s.logFailure("metric payload option function failed", err, "metric", req.Metric, "name", req.Name)
+		s.recordPanic(err, "metric-payload-options", req.Metric)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -120,40 +158,239 @@ func (s Server) query(w http.ResponseWriter, r *http.Request) {
 		s.logger.Error("invalid request", "err", err)
 		return
 	}
+	setRequestTarget(r.Context(), s.metricLabel(queryTargetName(queryRequest)))
+	if queryRequest.RequestID == "" {
+		// all targets of the request share the same ID, so their logs can be correlated (see RequestIDMiddleware).
+		queryRequest.RequestID = newRequestID()
+	}
+
+	if s.payloadValidation {
+		if errs := s.validatePayloads(queryRequest); len(errs) > 0 {
+			writeTargetErrors(w, errs)
+			return
+		}
+	}
+
+	responses, errs := s.queryTargets(r.Context(), queryRequest)
+	if len(errs) > 0 && s.reportQueryErrors {
+		writeTargetErrors(w, errs)
+		return
+	}
+
+	encoded, err := encodeQueryResponses(responses)
+	if err != nil {
+		http.Error(w, "query: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = writeQueryResponses(w, responses, encoded); err != nil {
+		s.logger.Warn("failed to write query response", "err", err)
+	}
+}
 
+// metricLabel returns the label for the metric in the server's Prometheus request metrics: the metric's name if the
+// metric is registered, unknownTargetLabel if it isn't.
+func (s Server) metricLabel(name string) string {
+	if _, ok := s.metricConfigs[name]; ok || name == "" {
+		return name
+	}
+	return unknownTargetLabel
+}
+
+// queryTargetName returns the target of the query request, if all its targets are for the same metric. Otherwise,
+// it returns a blank string.
+func queryTargetName(queryRequest QueryRequest) string {
+	var name string
+	for i, target := range queryRequest.Targets {
+		if i > 0 && target.Target != name {
+			return ""
+		}
+		name = target.Target
+	}
+	return name
+}
+
+// validatePayloads validates the payload of each target against the Payloads of its metric. Unknown targets are not
+// validated: these are reported by queryTargets.
+func (s Server) validatePayloads(queryRequest QueryRequest) []targetError {
+	var errs []targetError
+	for _, target := range queryRequest.Targets {
+		config, ok := s.metricConfigs[target.Target]
+		if !ok {
+			continue
+		}
+		if err := config.Metric.ValidatePayload(target.Payload); err != nil {
+			s.logger.Warn("invalid payload", "err", err, "target", target.Target, "refId", target.RefID)
+			errs = append(errs, newTargetError(target, err))
+		}
+	}
+	return errs
+}
+
+// queryTargets runs the query for each target in the request, with at most s.maxConcurrentTargets queries running in parallel.
+// Responses are returned in the order of the request's targets. Failed targets are logged and left out of the responses.
+// Instead, queryTargets returns an error for each failed target.
+func (s Server) queryTargets(ctx context.Context, queryRequest QueryRequest) ([]QueryResponse, []targetError) {
 	targetRefIDs := make(map[string][]QueryRequestTarget)
 	for _, target := range queryRequest.Targets {
 		targetRefIDs[target.RefID] = append(targetRefIDs[target.RefID], target)
 	}
-	responses := make([]QueryResponse, 0, len(queryRequest.Targets))
-	for _, t := range queryRequest.Targets {
-		queryRequest.Targets = targetRefIDs[t.RefID]
-		resp, err := s.queryTarget(r.Context(), t.Target, queryRequest)
-		if err != nil {
-			s.logger.Error("query failed", "err", err)
+
+	limit := s.maxConcurrentTargets
+	if limit <= 0 || limit > len(queryRequest.Targets) {
+		limit = len(queryRequest.Targets)
+	}
+	sem := make(chan struct{}, limit)
+
+	results := make([]QueryResponse, len(queryRequest.Targets))
+	errs := make([]error, len(queryRequest.Targets))
+	var wg sync.WaitGroup
+	for i, t := range queryRequest.Targets {
+		// don't start any new queries once the request has been cancelled
+		if errs[i] = ctx.Err(); errs[i] != nil {
 			continue
 		}
-		responses = append(responses, resp)
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			targetRequest := queryRequest
+			targetRequest.Targets = targetRefIDs[t.RefID]
+			targetRequest.Target = t
+			results[i], errs[i] = s.queryTarget(ctx, t.Target, targetRequest)
+		}()
 	}
+	wg.Wait()
 
-	w.Header().Set("Content-Type", "application/json")
-	if err = json.NewEncoder(w).Encode(responses); err != nil {
-		http.Error(w, "query: "+err.Error(), http.StatusInternalServerError)
+	responses := make([]QueryResponse, 0, len(results))
+	var targetErrs []targetError
+	for i, resp := range results {
+		if errs[i] != nil {
+			msg := "query failed"
+			if errors.Is(errs[i], ErrQueryTimeout) {
+				msg = "query timed out"
+			}
+			s.logFailure(msg, errs[i], "target", queryRequest.Targets[i].Target, "refId", queryRequest.Targets[i].RefID)
+			targetErrs = append(targetErrs, newTargetError(queryRequest.Targets[i], errs[i]))
+			continue
+		}
+		switch r := resp.(type) {
+		case DataFrameResponse:
+			if r.RefID == "" {
+				r.RefID = queryRequest.Targets[i].RefID
+			}
+			responses = append(responses, r)
+		case MultiTimeSeriesResponse:
+			for _, timeSeries := range r {
+				responses = append(responses, timeSeries)
+			}
+		default:
+			responses = append(responses, resp)
+		}
 	}
+	return responses, targetErrs
 }
 
 func (s Server) queryTarget(ctx context.Context, target string, req QueryRequest) (resp QueryResponse, err error) {
 	start := time.Now()
 
 	if datasource, ok := s.metricConfigs[target]; ok {
-		resp, err = datasource.Handler.Query(ctx, target, req)
+		timeout := s.queryTimeout
+		if datasource.timeout > 0 {
+			timeout = datasource.timeout
+		}
+		if timeout > 0 {
+			resp, err = queryWithTimeout(ctx, datasource.Handler, target, req, timeout)
+		} else {
+			resp, err = safeQuery(ctx, datasource.Handler, target, req)
+		}
+		if err == nil {
+			method := s.downsampling
+			if datasource.overrideDownsampling {
+				method = datasource.downsampling
+			}
+			resp = downsample(resp, req.MaxDataPoints, method)
+		}
 	} else {
-		err = fmt.Errorf("invalid target: %s", target)
+		err = fmt.Errorf("%w: %s", errInvalidTarget, target)
+		addUnknownTarget(ctx)
 	}
 	s.prometheusMetrics.Measure(target, time.Since(start), err)
 	return resp, err
 }
 
+// ErrQueryTimeout is returned for a target whose query did not complete within its configured timeout.
+var ErrQueryTimeout = errors.New("query timed out")
+
+// queryWithTimeout calls the handler with a context that expires after the timeout. If the handler does not return
+// in time, queryWithTimeout returns ErrQueryTimeout without waiting for the handler to complete.
+func queryWithTimeout(ctx context.Context, handler Handler, target string, req QueryRequest, timeout time.Duration) (QueryResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		resp QueryResponse
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := safeQuery(ctx, handler, target, req)
+		ch <- result{resp: resp, err: err}
+	}()
+
+	var r result
+	select {
+	case r = <-ch:
+		if r.err == nil {
+			return r.resp, nil
+		}
+	case <-ctx.Done():
+		r.err = ctx.Err()
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		r.err = fmt.Errorf("%w after %s: %w", ErrQueryTimeout, timeout, r.err)
+	}
+	return nil, r.err
+}
+
+// safeQuery calls the handler. If the handler panics, safeQuery returns the panic as a PanicError.
+func safeQuery(ctx context.Context, handler Handler, target string, req QueryRequest) (QueryResponse, error) {
+	return safeCall(func() (QueryResponse, error) { return handler.Query(ctx, target, req) })
+}
+
+// safeCall calls f. If f panics, safeCall returns the panic as a PanicError.
+func safeCall[T any](f func() (T, error)) (result T, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return f()
+}
+
+// logFailure logs an error. If the error is a PanicError, the stack trace is added.
+func (s Server) logFailure(msg string, err error, args ...any) {
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		args = append(args, "stack", string(panicErr.Stack))
+	}
+	s.logger.Error(msg, append([]any{"err", err}, args...)...)
+}
+
+// recordPanic counts a panic outside a query Handler, if the Prometheus metrics implement PanicRecorder.
+func (s Server) recordPanic(err error, endpoint, target string) {
+	var panicErr *PanicError
+	if recorder, ok := s.prometheusMetrics.(PanicRecorder); ok && errors.As(err, &panicErr) {
+		recorder.RecordPanic(endpoint, target)
+	}
+}
+
 func (s Server) variable(w http.ResponseWriter, r *http.Request) {
 	request, err := parseRequest[VariableRequest](w, r)
 	if err != nil {
@@ -161,17 +398,21 @@ func (s Server) variable(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	variableFunc, ok := s.variables[request.Target]
+	variableHandler, label, ok := s.findVariableHandler(&request)
+	setRequestTarget(r.Context(), label)
+	request.Route = label
 	if !ok {
+		addUnknownTarget(r.Context())
 		s.logger.Error("no variable handler found", "err", err)
 		w.Header().Set("Content-Type", "plain/text")
 		http.Error(w, "no variable handler found for '"+request.Target+"'", http.StatusBadRequest)
 		return
 	}
 
-	variables, err := variableFunc(request)
+	variables, err := safeCall(func() ([]Variable, error) { return variableHandler.Variables(r.Context(), request) })
 	if err != nil {
-		s.logger.Error("variable handler failed", "err", err, "target", request.Target)
+		s.logFailure("variable handler failed", err, "target", request.Target)
+		s.recordPanic(err, "variable", label)
 		w.Header().Set("Content-Type", "plain/text")
 		http.Error(w, "variables: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -181,10 +422,99 @@ func (s Server) variable(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(variables)
 }
 
+// findVariableHandler returns the VariableHandler for the request's target: the handler registered for the target's name,
+// the first handler whose pattern matches the target, or the default handler, in that order. If the handler was found
+// by a pattern, findVariableHandler stores the pattern's capture groups in the request's Matches.
+//
+// findVariableHandler also returns the label for the request in the server's Prometheus metrics: the registered name,
+// the pattern, defaultVariableLabel or, if no handler was found, unknownTargetLabel.
+func (s Server) findVariableHandler(request *VariableRequest) (VariableHandler, string, bool) {
+	if h, ok := s.variables[request.Target]; ok {
+		return h, request.Target, true
+	}
+	for _, pattern := range s.variablePatterns {
+		if matches := pattern.re.FindStringSubmatch(request.Target); matches != nil {
+			request.Matches = matches[1:]
+			return pattern.handler, pattern.pattern, true
+		}
+	}
+	if s.defaultVariable != nil {
+		return s.defaultVariable, defaultVariableLabel, true
+	}
+	return nil, unknownTargetLabel, false
+}
+
+func (s Server) tagKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if s.tagKeys == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	keys, err := s.tagKeys(r.Context())
+	if err != nil {
+		s.logger.Error("tag keys function failed", "err", err)
+		w.Header().Set("Content-Type", "plain/text")
+		http.Error(w, "tag keys: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(keys)
+}
+
+func (s Server) tagValuesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.tagValues == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	request, err := parseRequest[TagValuesRequest](w, r)
+	if err != nil {
+		s.logger.Error("invalid request", "err", err)
+		return
+	}
+
+	values, err := s.tagValues(r.Context(), request)
+	if err != nil {
+		s.logger.Error("tag values function failed", "err", err, "key", request.Key)
+		w.Header().Set("Content-Type", "plain/text")
+		http.Error(w, "tag values: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(values)
+}
+
+func (s Server) annotationsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.annotations == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	request, err := parseRequest[AnnotationRequest](w, r)
+	if err != nil {
+		s.logger.Error("invalid request", "err", err)
+		return
+	}
+
+	annotations, err := s.annotations.Annotations(r.Context(), request)
+	if err != nil {
+		s.logger.Error("annotation handler failed", "err", err, "annotation", request.Annotation.Name)
+		w.Header().Set("Content-Type", "plain/text")
+		http.Error(w, "annotations: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(annotations)
+}
+
 func parseRequest[T any](w http.ResponseWriter, r *http.Request) (T, error) {
 	var request T
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
+		updateRequestInfo(r.Context(), func(info *requestInfo) { info.decodeFailed = true })
 		w.Header().Set("Content-Type", "plain/text")
 		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
 	}
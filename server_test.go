@@ -5,10 +5,14 @@ import (
 	"context"
 	"errors"
 	gjson "github.com/clambin/grafana-json-server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -175,6 +179,18 @@ func TestServer_WithQuery(t *testing.T) {
 		gjson.WithHandler("fubar", gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
 			return nil, errors.New("fubar")
 		})),
+		gjson.WithHandler("multi", gjson.HandlerFunc(func(_ context.Context, _ string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			return gjson.MultiTimeSeriesResponse{
+				{Target: "host1", DataPoints: []gjson.DataPoint{{Timestamp: time.Date(2023, time.July, 15, 0, 0, 0, 0, time.UTC), Value: 1}}},
+				{Target: "host2", DataPoints: []gjson.DataPoint{{Timestamp: time.Date(2023, time.July, 15, 0, 0, 0, 0, time.UTC), Value: 2}}},
+			}, nil
+		})),
+		gjson.WithHandler("frame", gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			return gjson.DataFrameResponse{Fields: []gjson.Field{
+				{Name: "time", Values: gjson.TimeColumn{time.Date(2023, time.July, 15, 0, 0, 0, 0, time.UTC)}},
+				{Name: "value", Values: gjson.NumberColumn{10}, Config: &gjson.FieldConfig{Unit: "bytes"}},
+			}}, nil
+		})),
 		gjson.WithHandler("fubar2", gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
 			return gjson.TableResponse{Columns: []gjson.Column{
 				{Text: "time", Data: gjson.TimeColumn{time.Now()}},
@@ -226,6 +242,20 @@ func TestServer_WithQuery(t *testing.T) {
 			queryRequest:   `{ "targets": [ { "target": "bar" } ] }`,
 			wantStatusCode: http.StatusOK,
 			want: `[{"type":"table","columns":[{"text":"time","type":"time"},{"text":"value","type":"number"}],"rows":[["2023-07-15T00:00:00Z",10]]}]
+`,
+		},
+		{
+			name:           "multiple time series",
+			queryRequest:   `{ "targets": [ { "target": "multi", "refId": "A" }, { "target": "foo", "refId": "B" } ] }`,
+			wantStatusCode: http.StatusOK,
+			want: `[{"target":"host1","datapoints":[[1,1689379200000]]},{"target":"host2","datapoints":[[2,1689379200000]]},{"target":"foo","datapoints":[[10,1689379200000]]}]
+`,
+		},
+		{
+			name:           "dataframe",
+			queryRequest:   `{ "targets": [ { "target": "frame", "refId": "A" } ] }`,
+			wantStatusCode: http.StatusOK,
+			want: `[{"refId":"A","fields":[{"name":"time","type":"time","values":[1689379200000]},{"name":"value","type":"number","config":{"unit":"bytes"},"values":[10]}]}]
 `,
 		},
 		{
@@ -247,7 +277,7 @@ func TestServer_WithQuery(t *testing.T) {
 			name:           "invalid response",
 			queryRequest:   `{ "targets": [ { "target": "fubar2" } ] }`,
 			wantStatusCode: http.StatusInternalServerError,
-			want: `query: json: error calling MarshalJSON for type grafana_json_server.QueryResponse: error building table query output: all columns must have the same number of rows
+			want: `query: error building table query output: all columns must have the same number of rows
 `,
 		},
 		{
@@ -275,6 +305,31 @@ func TestServer_WithQuery(t *testing.T) {
 	}
 }
 
+func TestServer_DuplicateTargets(t *testing.T) {
+	h := gjson.NewServer(
+		gjson.WithHandler("foo", gjson.HandlerFunc(func(_ context.Context, _ string, req gjson.QueryRequest) (gjson.QueryResponse, error) {
+			var payload struct {
+				Series string
+			}
+			if err := req.Target.GetPayload(&payload); err != nil {
+				return nil, err
+			}
+			return gjson.TimeSeriesResponse{Target: req.Target.RefID + ":" + payload.Series}, nil
+		})),
+	)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/query", strings.NewReader(`{ "targets": [
+		{ "target": "foo", "refId": "A", "payload": { "series": "cpu" } },
+		{ "target": "foo", "refId": "B", "payload": { "series": "mem" } }
+	] }`))
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `[{"target":"A:cpu","datapoints":null},{"target":"B:mem","datapoints":null}]
+`, w.Body.String())
+}
+
 func TestServer_Tags(t *testing.T) {
 	s := gjson.NewServer()
 
@@ -290,3 +345,347 @@ func TestServer_Tags(t *testing.T) {
 	s.ServeHTTP(w, r)
 	assert.Equal(t, http.StatusNotImplemented, w.Code)
 }
+
+func TestServer_WithTags(t *testing.T) {
+	h := gjson.NewServer(
+		gjson.WithTagKeys(func(_ context.Context) ([]gjson.TagKey, error) {
+			return []gjson.TagKey{
+				{Type: gjson.TagKeyTypeString, Text: "City"},
+				{Type: gjson.TagKeyTypeNumber, Text: "Population"},
+			}, nil
+		}),
+		gjson.WithTagValues(func(_ context.Context, req gjson.TagValuesRequest) ([]gjson.TagValue, error) {
+			switch req.Key {
+			case "City":
+				return []gjson.TagValue{{Text: "Berlin"}, {Text: "Brussels"}}, nil
+			default:
+				return nil, errors.New("invalid key")
+			}
+		}),
+	)
+
+	testCases := []struct {
+		name           string
+		path           string
+		request        string
+		wantStatusCode int
+		want           string
+	}{
+		{
+			name:           "keys",
+			path:           "/tag-keys",
+			request:        `{}`,
+			wantStatusCode: http.StatusOK,
+			want: `[{"type":"string","text":"City"},{"type":"number","text":"Population"}]
+`,
+		},
+		{
+			name:           "values",
+			path:           "/tag-values",
+			request:        `{ "key": "City" }`,
+			wantStatusCode: http.StatusOK,
+			want: `[{"text":"Berlin"},{"text":"Brussels"}]
+`,
+		},
+		{
+			name:           "values - failing",
+			path:           "/tag-values",
+			request:        `{ "key": "Country" }`,
+			wantStatusCode: http.StatusInternalServerError,
+		},
+		{
+			name:           "values - invalid",
+			path:           "/tag-values",
+			request:        `not a json object`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "http://localhost"+tt.path, io.NopCloser(bytes.NewBufferString(tt.request)))
+			h.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.wantStatusCode, w.Code)
+			if w.Code == http.StatusOK {
+				assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+				assert.Equal(t, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServer_WithAnnotations(t *testing.T) {
+	h := gjson.NewServer(
+		gjson.WithAnnotationHandler(gjson.AnnotationHandlerFunc(func(_ context.Context, req gjson.AnnotationRequest) ([]gjson.Annotation, error) {
+			if req.Annotation.Query != "deploy" {
+				return nil, errors.New("invalid query")
+			}
+			return []gjson.Annotation{
+				{
+					Time:  time.Date(2023, time.July, 15, 0, 0, 0, 0, time.UTC),
+					Title: "deployment",
+					Text:  "v1.0.0",
+					Tags:  []string{"prod"},
+				},
+				{
+					Time:    time.Date(2023, time.July, 15, 1, 0, 0, 0, time.UTC),
+					TimeEnd: time.Date(2023, time.July, 15, 2, 0, 0, 0, time.UTC),
+					Text:    "maintenance",
+				},
+			}, nil
+		})),
+	)
+
+	testCases := []struct {
+		name           string
+		request        string
+		wantStatusCode int
+		want           string
+	}{
+		{
+			name:           "valid",
+			request:        `{ "annotation": { "name": "deploy", "enable": true, "query": "deploy" }, "range": { "from": "2023-07-15T00:00:00.000Z", "to": "2023-07-16T00:00:00.000Z" } }`,
+			wantStatusCode: http.StatusOK,
+			want: `[{"time":1689379200000,"title":"deployment","text":"v1.0.0","tags":["prod"]},{"time":1689382800000,"timeEnd":1689386400000,"isRegion":true,"text":"maintenance"}]
+`,
+		},
+		{
+			name:           "failing",
+			request:        `{ "annotation": { "name": "deploy", "enable": true, "query": "foo" } }`,
+			wantStatusCode: http.StatusInternalServerError,
+		},
+		{
+			name:           "invalid",
+			request:        `not a json object`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "http://localhost/annotations", io.NopCloser(bytes.NewBufferString(tt.request)))
+			h.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.wantStatusCode, w.Code)
+			if w.Code == http.StatusOK {
+				assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+				assert.Equal(t, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServer_Annotations_NotImplemented(t *testing.T) {
+	s := gjson.NewServer()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(http.MethodPost, "http://localhost/annotations", nil)
+
+	s.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestServer_ConcurrentTargets(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	h := gjson.NewServer(
+		gjson.WithMaxConcurrentTargets(2),
+		gjson.WithHandler("foo", gjson.HandlerFunc(func(_ context.Context, target string, req gjson.QueryRequest) (gjson.QueryResponse, error) {
+			current := running.Add(1)
+			defer running.Add(-1)
+			for {
+				highest := maxRunning.Load()
+				if current <= highest || maxRunning.CompareAndSwap(highest, current) {
+					break
+				}
+			}
+			var payload struct {
+				Delay int
+			}
+			if err := req.GetPayload(target, &payload); err != nil {
+				return nil, err
+			}
+			time.Sleep(time.Duration(payload.Delay) * time.Millisecond)
+			return gjson.TimeSeriesResponse{Target: req.Targets[0].RefID}, nil
+		})),
+	)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/query", io.NopCloser(bytes.NewBufferString(`{ "targets": [
+	{ "target": "foo", "refId": "A", "payload": { "delay": 100 } },
+	{ "target": "foo", "refId": "B", "payload": { "delay": 10 } },
+	{ "target": "foo", "refId": "C", "payload": { "delay": 50 } },
+	{ "target": "foo", "refId": "D", "payload": { "delay": 10 } }
+]}`)))
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `[{"target":"A","datapoints":null},{"target":"B","datapoints":null},{"target":"C","datapoints":null},{"target":"D","datapoints":null}]
+`, w.Body.String())
+	assert.Equal(t, int32(2), maxRunning.Load())
+}
+
+func TestServer_ConcurrentTargets_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls atomic.Int32
+	h := gjson.NewServer(
+		gjson.WithMaxConcurrentTargets(1),
+		gjson.WithHandler("foo", gjson.HandlerFunc(func(ctx context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			calls.Add(1)
+			cancel()
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})),
+	)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/query", io.NopCloser(bytes.NewBufferString(`{ "targets": [
+	{ "target": "foo", "refId": "A" },
+	{ "target": "foo", "refId": "B" },
+	{ "target": "foo", "refId": "C" }
+]}`)))
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]\n", w.Body.String())
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestServer_WithQueryErrorReporting(t *testing.T) {
+	errBackend := errors.New("connection refused")
+	h := gjson.NewServer(
+		gjson.WithQueryErrorReporting(),
+		gjson.WithHandler("foo", gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			return gjson.TimeSeriesResponse{Target: target}, nil
+		})),
+		gjson.WithHandler("internal", gjson.HandlerFunc(func(_ context.Context, _ string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			return nil, errBackend
+		})),
+		gjson.WithHandler("visible", gjson.HandlerFunc(func(_ context.Context, _ string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			return nil, &gjson.QueryError{Message: "backend unavailable", Err: errBackend}
+		})),
+	)
+
+	testCases := []struct {
+		name           string
+		queryRequest   string
+		wantStatusCode int
+		want           string
+	}{
+		{
+			name:           "success",
+			queryRequest:   `{ "targets": [ { "target": "foo", "refId": "A" } ] }`,
+			wantStatusCode: http.StatusOK,
+			want: `[{"target":"foo","datapoints":null}]
+`,
+		},
+		{
+			name:           "missing",
+			queryRequest:   `{ "targets": [ { "target": "foo", "refId": "A" }, { "target": "not-a-target", "refId": "B" } ] }`,
+			wantStatusCode: http.StatusBadRequest,
+			want: `{"message":"B: invalid target: not-a-target","errors":[{"refId":"B","target":"not-a-target","message":"invalid target: not-a-target"}]}
+`,
+		},
+		{
+			name:           "internal error",
+			queryRequest:   `{ "targets": [ { "target": "internal", "refId": "A" } ] }`,
+			wantStatusCode: http.StatusInternalServerError,
+			want: `{"message":"A: query failed","errors":[{"refId":"A","target":"internal","message":"query failed"}]}
+`,
+		},
+		{
+			name:           "user-visible error",
+			queryRequest:   `{ "targets": [ { "target": "visible", "refId": "A" }, { "target": "not-a-target", "refId": "B" } ] }`,
+			wantStatusCode: http.StatusInternalServerError,
+			want: `{"message":"A: backend unavailable; B: invalid target: not-a-target","errors":[{"refId":"A","target":"visible","message":"backend unavailable"},{"refId":"B","target":"not-a-target","message":"invalid target: not-a-target"}]}
+`,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "http://localhost/query", io.NopCloser(bytes.NewBufferString(tt.queryRequest)))
+			h.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.wantStatusCode, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.Equal(t, tt.want, w.Body.String())
+		})
+	}
+}
+
+func TestServer_PanicRecovery(t *testing.T) {
+	var logOutput bytes.Buffer
+	metrics := gjson.NewDefaultPrometheusQueryMetrics("", "", "test")
+	h := gjson.NewServer(
+		gjson.WithLogger(slog.New(slog.NewTextHandler(&logOutput, nil))),
+		gjson.WithPrometheusQueryMetrics(metrics),
+		gjson.WithHandler("foo", gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			return gjson.TimeSeriesResponse{Target: target}, nil
+		})),
+		gjson.WithMetric(gjson.Metric{Value: "panic"}, gjson.HandlerFunc(func(_ context.Context, _ string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			panic("query panicked")
+		}), func(_ gjson.MetricPayloadOptionsRequest) ([]gjson.MetricPayloadOption, error) {
+			panic("payload options panicked")
+		}),
+		gjson.WithVariable("panic", func(_ gjson.VariableRequest) ([]gjson.Variable, error) {
+			panic("variable panicked")
+		}),
+	)
+
+	tests := []struct {
+		name           string
+		path           string
+		request        string
+		wantStatusCode int
+		want           string
+	}{
+		{
+			name:           "query",
+			path:           "/query",
+			request:        `{ "targets": [ { "target": "panic", "refId": "A" }, { "target": "foo", "refId": "B" } ] }`,
+			wantStatusCode: http.StatusOK,
+			want: `[{"target":"foo","datapoints":null}]
+`,
+		},
+		{
+			name:           "variable",
+			path:           "/variable",
+			request:        `{ "payload": { "target": "panic" } }`,
+			wantStatusCode: http.StatusInternalServerError,
+			want: `variables: panic: variable panicked
+`,
+		},
+		{
+			name:           "metric payload options",
+			path:           "/metric-payload-options",
+			request:        `{ "metric": "panic", "name": "option" }`,
+			wantStatusCode: http.StatusInternalServerError,
+			want: `panic: payload options panicked
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "http://localhost"+tt.path, io.NopCloser(strings.NewReader(tt.request)))
+			h.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantStatusCode, w.Code)
+			assert.Equal(t, tt.want, w.Body.String())
+		})
+	}
+
+	assert.Contains(t, logOutput.String(), `err="panic: query panicked"`)
+	assert.Contains(t, logOutput.String(), "stack=")
+	assert.NoError(t, testutil.CollectAndCompare(metrics, strings.NewReader(`
+# HELP json_panic_count Grafana JSON Data server count of recovered panics
+# TYPE json_panic_count counter
+json_panic_count{application="test",endpoint="metric-payload-options",target="panic"} 1
+json_panic_count{application="test",endpoint="query",target="panic"} 1
+json_panic_count{application="test",endpoint="variable",target="panic"} 1
+`), `json_panic_count`))
+}
@@ -0,0 +1,389 @@
+package grafana_json_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// A StreamingQueryResponse is a QueryResponse that can write its JSON encoding directly to an io.Writer, without
+// building the full encoding in memory first. The server uses WriteJSON, rather than MarshalJSON, to send the response.
+//
+// TimeSeriesResponse, MultiTimeSeriesResponse and TableResponse implement this interface.
+type StreamingQueryResponse interface {
+	QueryResponse
+	WriteJSON(w io.Writer) error
+}
+
+var (
+	_ StreamingQueryResponse = TimeSeriesResponse{}
+	_ StreamingQueryResponse = MultiTimeSeriesResponse{}
+	_ StreamingQueryResponse = TableResponse{}
+)
+
+// WriteJSON writes the JSON encoding of the TimeSeriesResponse to w. If the response is invalid, WriteJSON returns an
+// error without writing any output.
+func (r TimeSeriesResponse) WriteJSON(w io.Writer) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	s := newJSONStream(w)
+	r.writeJSON(s)
+	return s.flush()
+}
+
+// writeJSON appends the JSON encoding of the TimeSeriesResponse to the stream. The response must be valid.
+func (r TimeSeriesResponse) writeJSON(s *jsonStream) {
+	s.writeTimeSeries(r)
+}
+
+// WriteJSON writes the JSON encoding of the MultiTimeSeriesResponse to w. If the response is invalid, WriteJSON returns
+// an error without writing any output.
+func (r MultiTimeSeriesResponse) WriteJSON(w io.Writer) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	s := newJSONStream(w)
+	r.writeJSON(s)
+	return s.flush()
+}
+
+// writeJSON appends the JSON encoding of the MultiTimeSeriesResponse to the stream. The response must be valid.
+func (r MultiTimeSeriesResponse) writeJSON(s *jsonStream) {
+	s.buf = append(s.buf, '[')
+	for i, timeSeries := range r {
+		if i > 0 {
+			s.buf = append(s.buf, ',')
+		}
+		s.writeTimeSeries(timeSeries)
+	}
+	s.buf = append(s.buf, ']')
+}
+
+// WriteJSON writes the JSON encoding of the TableResponse to w. If the table is invalid, WriteJSON returns an error
+// without writing any output.
+func (t TableResponse) WriteJSON(w io.Writer) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	s := newJSONStream(w)
+	t.writeJSON(s)
+	return s.flush()
+}
+
+// writeJSON appends the JSON encoding of the TableResponse to the stream. The table must be valid.
+func (t TableResponse) writeJSON(s *jsonStream) {
+	colTypes, rowCount, _ := t.getColumnDetails()
+	s.buf = append(s.buf, `{"type":"table","columns":[`...)
+	for i, colType := range colTypes {
+		if i > 0 {
+			s.buf = append(s.buf, ',')
+		}
+		s.buf = append(s.buf, `{"text":`...)
+		s.buf = appendJSONString(s.buf, t.Columns[i].Text)
+		s.buf = append(s.buf, `,"type":`...)
+		s.buf = appendJSONString(s.buf, colType)
+		s.buf = append(s.buf, '}')
+	}
+	s.buf = append(s.buf, `],"rows":[`...)
+	for row := 0; row < rowCount; row++ {
+		if row > 0 {
+			s.buf = append(s.buf, ',')
+		}
+		s.buf = append(s.buf, '[')
+		for column, entry := range t.Columns {
+			if column > 0 {
+				s.buf = append(s.buf, ',')
+			}
+			s.buf = appendCell(s.buf, entry.Data, row)
+		}
+		s.buf = append(s.buf, ']')
+		s.flushIfFull()
+	}
+	s.buf = append(s.buf, "]}"...)
+}
+
+// validate checks that the TimeSeriesResponse can be encoded, so the server can report an error before writing the response.
+func (r TimeSeriesResponse) validate() error {
+	for _, dataPoint := range r.DataPoints {
+		if err := validateFloat(dataPoint.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r MultiTimeSeriesResponse) validate() error {
+	for _, timeSeries := range r {
+		if err := timeSeries.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t TableResponse) validate() error {
+	if _, _, err := t.getColumnDetails(); err != nil {
+		return err
+	}
+	for _, column := range t.Columns {
+		var err error
+		switch data := column.Data.(type) {
+		case NumberColumn:
+			for i := 0; i < len(data) && err == nil; i++ {
+				err = validateFloat(data[i])
+			}
+		case NullableNumberColumn:
+			for i := 0; i < len(data) && err == nil; i++ {
+				err = validateFloat(valueOrZero(data[i]))
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("error building table query output: column %q: %w", column.Text, err)
+		}
+	}
+	return nil
+}
+
+// validateFloat returns an error if f cannot be encoded as JSON.
+func validateFloat(f float64) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("unsupported value: %v", f)
+	}
+	return nil
+}
+
+// encodeQueryResponses prepares the responses to be written by writeQueryResponses. Responses that implement
+// StreamingQueryResponse are validated, so any error is reported before the response is written. All other responses
+// are encoded.
+func encodeQueryResponses(responses []QueryResponse) ([][]byte, error) {
+	encoded := make([][]byte, len(responses))
+	for i, resp := range responses {
+		var err error
+		switch r := resp.(type) {
+		case interface{ validate() error }:
+			err = r.validate()
+		case StreamingQueryResponse:
+		default:
+			encoded[i], err = marshalQueryResponse(resp)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return encoded, nil
+}
+
+// writeQueryResponses writes the responses to w as a JSON array. Responses that implement StreamingQueryResponse are
+// written directly to w. For all other responses, the encoding prepared by encodeQueryResponses is written.
+//
+// All responses share the same jsonStream, so a request with many small time series allocates a single buffer.
+func writeQueryResponses(w io.Writer, responses []QueryResponse, encoded [][]byte) error {
+	s := newJSONStream(w)
+	s.buf = append(s.buf, '[')
+	for i, resp := range responses {
+		if i > 0 {
+			s.buf = append(s.buf, ',')
+		}
+		switch r := resp.(type) {
+		case interface{ writeJSON(*jsonStream) }:
+			// already validated by encodeQueryResponses
+			r.writeJSON(s)
+			s.flushIfFull()
+		case StreamingQueryResponse:
+			if err := s.flush(); err != nil {
+				return err
+			}
+			if err := r.WriteJSON(w); err != nil {
+				return err
+			}
+		default:
+			s.write(encoded[i])
+		}
+	}
+	s.buf = append(s.buf, "]\n"...)
+	return s.flush()
+}
+
+// marshalQueryResponse returns the JSON encoding of a QueryResponse in the same way as json.Encoder would:
+// compacted and with HTML characters escaped.
+func marshalQueryResponse(resp QueryResponse) ([]byte, error) {
+	body, err := resp.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var compacted bytes.Buffer
+	if err = json.Compact(&compacted, body); err != nil {
+		return nil, err
+	}
+	var escaped bytes.Buffer
+	json.HTMLEscape(&escaped, compacted.Bytes())
+	return escaped.Bytes(), nil
+}
+
+// jsonStream buffers JSON output and writes it to the underlying io.Writer in chunks.
+type jsonStream struct {
+	w   io.Writer
+	buf []byte
+	err error
+}
+
+const jsonStreamBufferSize = 32 * 1024
+
+func newJSONStream(w io.Writer) *jsonStream {
+	return &jsonStream{w: w, buf: make([]byte, 0, jsonStreamBufferSize+1024)}
+}
+
+// write adds b to the stream. Large slices are written to the underlying io.Writer directly, rather than copied to the buffer.
+func (s *jsonStream) write(b []byte) {
+	if len(s.buf)+len(b) <= jsonStreamBufferSize {
+		s.buf = append(s.buf, b...)
+		return
+	}
+	if s.flush() == nil {
+		_, s.err = s.w.Write(b)
+	}
+}
+
+func (s *jsonStream) flushIfFull() {
+	if len(s.buf) >= jsonStreamBufferSize {
+		_ = s.flush()
+	}
+}
+
+func (s *jsonStream) flush() error {
+	if s.err == nil && len(s.buf) > 0 {
+		_, s.err = s.w.Write(s.buf)
+	}
+	s.buf = s.buf[:0]
+	return s.err
+}
+
+func (s *jsonStream) writeTimeSeries(r TimeSeriesResponse) {
+	s.buf = append(s.buf, `{"target":`...)
+	s.buf = appendJSONString(s.buf, r.Target)
+	s.buf = append(s.buf, `,"datapoints":`...)
+	if r.DataPoints == nil {
+		s.buf = append(s.buf, "null}"...)
+		return
+	}
+	s.buf = append(s.buf, '[')
+	for i, dataPoint := range r.DataPoints {
+		if i > 0 {
+			s.buf = append(s.buf, ',')
+		}
+		// same encoding as DataPoint.MarshalJSON
+		s.buf = append(s.buf, '[')
+		s.buf = strconv.AppendFloat(s.buf, dataPoint.Value, 'f', -1, 64)
+		s.buf = append(s.buf, ',')
+		s.buf = strconv.AppendInt(s.buf, dataPoint.Timestamp.UnixMilli(), 10)
+		s.buf = append(s.buf, ']')
+		s.flushIfFull()
+	}
+	s.buf = append(s.buf, "]}"...)
+}
+
+// appendCell appends the JSON encoding of one row of a table column.
+func appendCell(buf []byte, data any, row int) []byte {
+	switch data := data.(type) {
+	case TimeColumn:
+		return appendJSONTime(buf, data[row])
+	case StringColumn:
+		return appendJSONString(buf, data[row])
+	case NumberColumn:
+		return appendJSONFloat(buf, data[row])
+	case IntColumn:
+		return strconv.AppendInt(buf, data[row], 10)
+	case BoolColumn:
+		return strconv.AppendBool(buf, data[row])
+	case NullableTimeColumn:
+		return appendNullable(buf, data[row], appendJSONTime)
+	case NullableStringColumn:
+		return appendNullable(buf, data[row], appendJSONString)
+	case NullableNumberColumn:
+		return appendNullable(buf, data[row], appendJSONFloat)
+	case NullableIntColumn:
+		return appendNullable(buf, data[row], func(buf []byte, v int64) []byte { return strconv.AppendInt(buf, v, 10) })
+	case NullableBoolColumn:
+		return appendNullable(buf, data[row], strconv.AppendBool)
+	default:
+		return append(buf, "null"...)
+	}
+}
+
+func appendNullable[T any](buf []byte, value *T, appendValue func([]byte, T) []byte) []byte {
+	if value == nil {
+		return append(buf, "null"...)
+	}
+	return appendValue(buf, *value)
+}
+
+func appendJSONTime(buf []byte, t time.Time) []byte {
+	buf = append(buf, '"')
+	buf = t.AppendFormat(buf, time.RFC3339Nano)
+	return append(buf, '"')
+}
+
+// appendJSONFloat encodes a float64 in the same way as TableResponse.MarshalJSON.
+func appendJSONFloat(buf []byte, f float64) []byte {
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	return strconv.AppendFloat(buf, f, format, -1, 64)
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString encodes a string in the same way as encoding/json, i.e. with HTML characters escaped.
+func appendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				buf = append(buf, '\\', b)
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		if c == '\u2028' || c == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, '\\', 'u', '2', '0', '2', hexDigits[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
@@ -0,0 +1,186 @@
+package grafana_json_server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	gjson "github.com/clambin/grafana-json-server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamingQueryResponse_WriteJSON(t *testing.T) {
+	timestamp := time.Date(2024, time.March, 8, 12, 30, 15, 123_000_000, time.UTC)
+
+	tests := []struct {
+		name     string
+		response gjson.StreamingQueryResponse
+	}{
+		{
+			name: "timeseries",
+			response: gjson.TimeSeriesResponse{Target: "A<&>\"B\"", DataPoints: []gjson.DataPoint{
+				{Timestamp: timestamp, Value: 1.5},
+				{Timestamp: timestamp.Add(time.Minute), Value: -1e22},
+			}},
+		},
+		{
+			name:     "timeseries - no datapoints",
+			response: gjson.TimeSeriesResponse{Target: "A"},
+		},
+		{
+			name:     "timeseries - empty datapoints",
+			response: gjson.TimeSeriesResponse{Target: "A", DataPoints: []gjson.DataPoint{}},
+		},
+		{
+			name: "multi timeseries",
+			response: gjson.MultiTimeSeriesResponse{
+				{Target: "A", DataPoints: []gjson.DataPoint{{Timestamp: timestamp, Value: 1}}},
+				{Target: "B", DataPoints: []gjson.DataPoint{{Timestamp: timestamp, Value: 2}}},
+			},
+		},
+		{
+			name: "table",
+			response: gjson.TableResponse{Columns: []gjson.Column{
+				{Text: "time", Data: gjson.TimeColumn{timestamp, timestamp.Add(time.Hour)}},
+				{Text: "label", Data: gjson.StringColumn{"tab\tnewline\n<html>", "bad utf-8 \xff, separators \u2028\u2029, ünïcödé"}},
+				{Text: "value", Data: gjson.NumberColumn{1e-7, 123456789.125}},
+				{Text: "count", Data: gjson.IntColumn{-1, math.MaxInt64}},
+				{Text: "ok", Data: gjson.BoolColumn{true, false}},
+				{Text: "nullable time", Data: gjson.NullableTimeColumn{&timestamp, nil}},
+				{Text: "nullable label", Data: gjson.NullableStringColumn{nil, ptr("foo")}},
+				{Text: "nullable value", Data: gjson.NullableNumberColumn{ptr(0.5), nil}},
+				{Text: "nullable count", Data: gjson.NullableIntColumn{nil, ptr[int64](10)}},
+				{Text: "nullable ok", Data: gjson.NullableBoolColumn{ptr(true), nil}},
+			}},
+		},
+		{
+			name:     "table - empty",
+			response: gjson.TableResponse{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := json.Marshal(tt.response)
+			require.NoError(t, err)
+
+			var got bytes.Buffer
+			require.NoError(t, tt.response.WriteJSON(&got))
+			assert.Equal(t, string(want), got.String())
+		})
+	}
+}
+
+func TestStreamingQueryResponse_WriteJSON_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		response gjson.StreamingQueryResponse
+		wantErr  string
+	}{
+		{
+			name:     "timeseries - NaN",
+			response: gjson.TimeSeriesResponse{Target: "A", DataPoints: []gjson.DataPoint{{Value: math.NaN()}}},
+			wantErr:  "unsupported value: NaN",
+		},
+		{
+			name: "table - row count",
+			response: gjson.TableResponse{Columns: []gjson.Column{
+				{Text: "A", Data: gjson.NumberColumn{1, 2}},
+				{Text: "B", Data: gjson.NumberColumn{1}},
+			}},
+			wantErr: "error building table query output: all columns must have the same number of rows",
+		},
+		{
+			name: "table - infinity",
+			response: gjson.TableResponse{Columns: []gjson.Column{
+				{Text: "A", Data: gjson.NullableNumberColumn{ptr(math.Inf(1))}},
+			}},
+			wantErr: `error building table query output: column "A": unsupported value: +Inf`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got bytes.Buffer
+			assert.EqualError(t, tt.response.WriteJSON(&got), tt.wantErr)
+			assert.Zero(t, got.Len())
+		})
+	}
+}
+
+func TestStreamingQueryResponse_Allocations(t *testing.T) {
+	tests := []struct {
+		name     string
+		response gjson.StreamingQueryResponse
+	}{
+		{name: "timeseries", response: buildTimeSeriesResponse(1000)},
+		{name: "table", response: buildTableResponse(1000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			marshalAllocs := testing.AllocsPerRun(10, func() { _, _ = tt.response.MarshalJSON() })
+			streamAllocs := testing.AllocsPerRun(10, func() { _ = tt.response.WriteJSON(io.Discard) })
+			assert.Less(t, streamAllocs, marshalAllocs)
+		})
+	}
+}
+
+func BenchmarkTimeSeriesResponse_WriteJSON(b *testing.B) {
+	response := buildTimeSeriesResponse(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := response.WriteJSON(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTableResponse_WriteJSON(b *testing.B) {
+	response := buildTableResponse(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := response.WriteJSON(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkServer_Query_ManyTimeSeries(b *testing.B) {
+	const targetCount = 100
+	options := make([]gjson.Option, 0, targetCount)
+	targets := make([]string, 0, targetCount)
+	for i := 0; i < targetCount; i++ {
+		target := "target-" + strconv.Itoa(i)
+		options = append(options, gjson.WithHandler(target, gjson.HandlerFunc(func(_ context.Context, target string, _ gjson.QueryRequest) (gjson.QueryResponse, error) {
+			response := buildTimeSeriesResponse(5)
+			response.Target = target
+			return response, nil
+		})))
+		targets = append(targets, `{ "target": "`+target+`" }`)
+	}
+	s := gjson.NewServer(options...)
+	body := `{ "targets": [ ` + strings.Join(targets, ", ") + ` ] }`
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost/query", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			b.Fatal(w.Code)
+		}
+	}
+}
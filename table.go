@@ -0,0 +1,126 @@
+package grafana_json_server
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// TableResponseFromSlice builds a TableResponse from a slice of structs (or pointers to structs). Each exported field
+// of the struct becomes a column.
+//
+// The column type is derived from the field's type: time.Time becomes a TimeColumn, strings a StringColumn, integers
+// an IntColumn, floats a NumberColumn and bools a BoolColumn. Pointer fields become the corresponding Nullable column,
+// with nil pointers sent as null.
+//
+// A field's column can be configured with a "grafana" tag, holding the column name and, optionally, its type:
+//
+//	type Row struct {
+//		Timestamp time.Time `grafana:"Time"`
+//		Host      string    `grafana:"Host"`
+//		Count     int       `grafana:"Count,number"`
+//		Port      int       `grafana:"Port,string"`
+//		Internal  string    `grafana:"-"`
+//	}
+//
+// If the tag holds no name, the field name is used. A type of "number" sends integers as a NumberColumn. A type of
+// "string" sends any value as a StringColumn. Fields tagged with "-" are skipped.
+func TableResponseFromSlice[T any](rows []T) (TableResponse, error) {
+	rowType := reflect.TypeOf((*T)(nil)).Elem()
+	isPointer := rowType.Kind() == reflect.Pointer
+	if isPointer {
+		rowType = rowType.Elem()
+	}
+	if rowType.Kind() != reflect.Struct {
+		return TableResponse{}, fmt.Errorf("table: %s is not a struct", rowType)
+	}
+
+	values := make([]reflect.Value, len(rows))
+	for i, row := range rows {
+		values[i] = reflect.ValueOf(row)
+		if isPointer {
+			if values[i].IsNil() {
+				return TableResponse{}, fmt.Errorf("table: row %d is nil", i)
+			}
+			values[i] = values[i].Elem()
+		}
+	}
+
+	var response TableResponse
+	for i := 0; i < rowType.NumField(); i++ {
+		field := rowType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, columnType, _ := strings.Cut(field.Tag.Get("grafana"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		data, err := buildColumn(values, i, field.Type, columnType)
+		if err != nil {
+			return TableResponse{}, fmt.Errorf("table: field %s: %w", field.Name, err)
+		}
+		response.Columns = append(response.Columns, Column{Text: name, Data: data})
+	}
+	return response, nil
+}
+
+func buildColumn(rows []reflect.Value, field int, fieldType reflect.Type, columnType string) (any, error) {
+	nullable := fieldType.Kind() == reflect.Pointer
+	if nullable {
+		fieldType = fieldType.Elem()
+	}
+
+	if columnType == "string" {
+		return makeColumn[StringColumn, NullableStringColumn](rows, field, nullable, func(v reflect.Value) string { return fmt.Sprint(v.Interface()) }), nil
+	}
+
+	switch kind := fieldType.Kind(); {
+	case fieldType == timeType && (columnType == "" || columnType == "time"):
+		return makeColumn[TimeColumn, NullableTimeColumn](rows, field, nullable, func(v reflect.Value) time.Time { return v.Interface().(time.Time) }), nil
+	case kind == reflect.String && columnType == "":
+		return makeColumn[StringColumn, NullableStringColumn](rows, field, nullable, reflect.Value.String), nil
+	case kind == reflect.Bool && (columnType == "" || columnType == "boolean"):
+		return makeColumn[BoolColumn, NullableBoolColumn](rows, field, nullable, reflect.Value.Bool), nil
+	case kind >= reflect.Int && kind <= reflect.Int64 && columnType == "":
+		return makeColumn[IntColumn, NullableIntColumn](rows, field, nullable, reflect.Value.Int), nil
+	case kind >= reflect.Uint && kind <= reflect.Uint64 && columnType == "":
+		return makeColumn[IntColumn, NullableIntColumn](rows, field, nullable, func(v reflect.Value) int64 { return int64(v.Uint()) }), nil
+	case kind >= reflect.Int && kind <= reflect.Int64 && columnType == "number":
+		return makeColumn[NumberColumn, NullableNumberColumn](rows, field, nullable, func(v reflect.Value) float64 { return float64(v.Int()) }), nil
+	case kind >= reflect.Uint && kind <= reflect.Uint64 && columnType == "number":
+		return makeColumn[NumberColumn, NullableNumberColumn](rows, field, nullable, func(v reflect.Value) float64 { return float64(v.Uint()) }), nil
+	case (kind == reflect.Float32 || kind == reflect.Float64) && (columnType == "" || columnType == "number"):
+		return makeColumn[NumberColumn, NullableNumberColumn](rows, field, nullable, reflect.Value.Float), nil
+	default:
+		if columnType != "" {
+			return nil, fmt.Errorf("type %s cannot be sent as %q", fieldType, columnType)
+		}
+		return nil, fmt.Errorf("unsupported type %s", fieldType)
+	}
+}
+
+// makeColumn builds a column of type C (or, if nullable is true, of type N) from a struct field in each row.
+func makeColumn[C ~[]T, N ~[]*T, T any](rows []reflect.Value, field int, nullable bool, get func(reflect.Value) T) any {
+	if !nullable {
+		column := make(C, len(rows))
+		for i, row := range rows {
+			column[i] = get(row.Field(field))
+		}
+		return column
+	}
+	column := make(N, len(rows))
+	for i, row := range rows {
+		if v := row.Field(field); !v.IsNil() {
+			value := get(v.Elem())
+			column[i] = &value
+		}
+	}
+	return column
+}
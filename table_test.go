@@ -0,0 +1,66 @@
+package grafana_json_server_test
+
+import (
+	gjson "github.com/clambin/grafana-json-server"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTableResponseFromSlice(t *testing.T) {
+	type row struct {
+		Timestamp time.Time `grafana:"Time"`
+		Host      string
+		Count     int      `grafana:"Count,number"`
+		Port      uint16   `grafana:"Port,string"`
+		Up        bool     `grafana:"Up"`
+		Load      *float64 `grafana:"Load"`
+		Errors    *int     `grafana:"Errors"`
+		LastSeen  *time.Time
+		Internal  string `grafana:"-"`
+		private   string
+	}
+
+	timestamp := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	rows := []row{
+		{Timestamp: timestamp, Host: "foo", Count: 1, Port: 80, Up: true, Load: ptr(0.5), LastSeen: &timestamp, private: "x"},
+		{Timestamp: timestamp.Add(time.Minute), Host: "bar", Count: 2, Port: 443, Errors: ptr(3)},
+	}
+
+	resp, err := gjson.TableResponseFromSlice(rows)
+	assert.NoError(t, err)
+	assert.Equal(t, gjson.TableResponse{Columns: []gjson.Column{
+		{Text: "Time", Data: gjson.TimeColumn{timestamp, timestamp.Add(time.Minute)}},
+		{Text: "Host", Data: gjson.StringColumn{"foo", "bar"}},
+		{Text: "Count", Data: gjson.NumberColumn{1, 2}},
+		{Text: "Port", Data: gjson.StringColumn{"80", "443"}},
+		{Text: "Up", Data: gjson.BoolColumn{true, false}},
+		{Text: "Load", Data: gjson.NullableNumberColumn{ptr(0.5), nil}},
+		{Text: "Errors", Data: gjson.NullableIntColumn{nil, ptr(int64(3))}},
+		{Text: "LastSeen", Data: gjson.NullableTimeColumn{&timestamp, nil}},
+	}}, resp)
+
+	pointers, err := gjson.TableResponseFromSlice([]*row{&rows[0], &rows[1]})
+	assert.NoError(t, err)
+	assert.Equal(t, resp, pointers)
+
+	_, err = gjson.TableResponse.MarshalJSON(resp)
+	assert.NoError(t, err)
+}
+
+func TestTableResponseFromSlice_Errors(t *testing.T) {
+	_, err := gjson.TableResponseFromSlice([]string{"foo"})
+	assert.EqualError(t, err, "table: string is not a struct")
+
+	_, err = gjson.TableResponseFromSlice([]struct{ Values []float64 }{{}})
+	assert.EqualError(t, err, "table: field Values: unsupported type []float64")
+
+	_, err = gjson.TableResponseFromSlice([]struct {
+		Host string `grafana:"Host,number"`
+	}{{}})
+	assert.EqualError(t, err, `table: field Host: type string cannot be sent as "number"`)
+
+	type row struct{ Host string }
+	_, err = gjson.TableResponseFromSlice([]*row{nil})
+	assert.EqualError(t, err, "table: row 0 is nil")
+}
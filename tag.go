@@ -0,0 +1,62 @@
+package grafana_json_server
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// TagKeysFunc is the function signature of the function provided to WithTagKeys.
+// It returns the keys that can be used in ad-hoc filters.
+type TagKeysFunc func(ctx context.Context) ([]TagKey, error)
+
+// TagValuesFunc is the function signature of the function provided to WithTagValues.
+// It returns the possible values for the ad-hoc filter key in the TagValuesRequest.
+type TagValuesFunc func(ctx context.Context, req TagValuesRequest) ([]TagValue, error)
+
+// TagKeyType is the type of ad-hoc filter key: either TagKeyTypeString or TagKeyTypeNumber.
+type TagKeyType string
+
+const (
+	TagKeyTypeString TagKeyType = "string"
+	TagKeyTypeNumber TagKeyType = "number"
+)
+
+// TagKey is one key that can be used in an ad-hoc filter. Text is the name of the key.
+type TagKey struct {
+	Type TagKeyType `json:"type"`
+	Text string     `json:"text"`
+}
+
+// TagValuesRequest is the request sent to TagValuesFunc. Key is the ad-hoc filter key for which the possible values are requested.
+type TagValuesRequest struct {
+	Key string `json:"key"`
+}
+
+// TagValue is one possible value for an ad-hoc filter key.
+type TagValue struct {
+	Text string `json:"text"`
+}
+
+// AdhocFilter is one ad-hoc filter, as set up in the dashboard and sent to the server as part of the QueryRequest.
+type AdhocFilter struct {
+	Key       string `json:"key"`
+	Operator  string `json:"operator"`
+	Value     string `json:"value"`
+	Condition string `json:"condition,omitempty"`
+}
+
+// GetAdhocFilters returns the ad-hoc filters in the QueryRequest.
+func (r QueryRequest) GetAdhocFilters() ([]AdhocFilter, error) {
+	if len(r.AdhocFilters) == 0 {
+		return nil, nil
+	}
+	body, err := json.Marshal(r.AdhocFilters)
+	if err != nil {
+		return nil, err
+	}
+	var filters []AdhocFilter
+	if err = json.Unmarshal(body, &filters); err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
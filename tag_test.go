@@ -0,0 +1,49 @@
+package grafana_json_server_test
+
+import (
+	"encoding/json"
+	gjson "github.com/clambin/grafana-json-server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestQueryRequest_GetAdhocFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr assert.ErrorAssertionFunc
+		want    []gjson.AdhocFilter
+	}{
+		{
+			name:    "none",
+			input:   `{ "targets": [] }`,
+			wantErr: assert.NoError,
+		},
+		{
+			name:    "filters",
+			input:   `{ "adhocFilters": [ { "key": "City", "operator": "=", "value": "Berlin" }, { "key": "Country", "operator": "!=", "value": "Germany", "condition": "AND" } ] }`,
+			wantErr: assert.NoError,
+			want: []gjson.AdhocFilter{
+				{Key: "City", Operator: "=", Value: "Berlin"},
+				{Key: "Country", Operator: "!=", Value: "Germany", Condition: "AND"},
+			},
+		},
+		{
+			name:    "invalid",
+			input:   `{ "adhocFilters": [ { "key": 1 } ] }`,
+			wantErr: assert.Error,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req gjson.QueryRequest
+			require.NoError(t, json.Unmarshal([]byte(tt.input), &req))
+
+			filters, err := req.GetAdhocFilters()
+			tt.wantErr(t, err)
+			assert.Equal(t, tt.want, filters)
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package grafana_json_server
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+// TimeSeriesCacheOptions configures a TimeSeriesCache.
+type TimeSeriesCacheOptions struct {
+	// TTL is how long a time series remains in the cache after it was last updated.
+	TTL time.Duration
+	// MaxSize is the maximum memory size of all cached data points, in bytes. When the cache is full, the least recently
+	// used time series are removed. If MaxSize is zero, the cache size is not limited: expired time series are still
+	// removed as new time series are added.
+	MaxSize int
+	// Overlap is the most recent part of a cached time series that is requested again, as the backend may not have
+	// received all data for that period yet.
+	Overlap time.Duration
+}
+
+// A TimeSeriesCache incrementally caches the responses of one or more time series Handlers. Use its Handler method to
+// add caching to a Handler:
+//
+//	cache := grafanaJSONServer.NewTimeSeriesCache(grafanaJSONServer.TimeSeriesCacheOptions{TTL: time.Hour, Overlap: time.Minute})
+//	s := grafanaJSONServer.NewServer(
+//		grafanaJSONServer.WithHandler("metric1", cache.Handler(handler)),
+//	)
+//
+// For each target, payload and scoped variables, the cache keeps the data points of the last query. When a dashboard
+// refreshes, the Handler is only called for the part of the requested time range that is not in the cache. The result
+// is merged with the cached data points and trimmed to the requested time range.
+//
+// Responses that are not a TimeSeriesResponse are returned as is and are not cached.
+type TimeSeriesCache struct {
+	cache   *lruCache[timeSeriesCacheEntry]
+	overlap time.Duration
+}
+
+type timeSeriesCacheEntry struct {
+	target     string
+	from       time.Time
+	to         time.Time
+	dataPoints []DataPoint
+}
+
+var dataPointSize = int(reflect.TypeOf(DataPoint{}).Size())
+
+// NewTimeSeriesCache returns a new TimeSeriesCache, configured as per the provided TimeSeriesCacheOptions.
+func NewTimeSeriesCache(options TimeSeriesCacheOptions) *TimeSeriesCache {
+	return &TimeSeriesCache{
+		cache:   newLRUCache[timeSeriesCacheEntry](options.TTL, options.MaxSize),
+		overlap: options.Overlap,
+	}
+}
+
+// Handler returns a Handler that serves time series from the cache and calls handler for any data points not found in the cache.
+func (c *TimeSeriesCache) Handler(handler Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, target string, req QueryRequest) (QueryResponse, error) {
+		key, err := timeSeriesCacheKey(target, req)
+		if err != nil {
+			return handler.Query(ctx, target, req)
+		}
+
+		from, to := req.Range.From, req.Range.To
+		entry, ok := c.cache.get(key)
+		if !ok || to.Before(entry.from) || from.After(entry.to) {
+			return c.queryAll(ctx, handler, key, target, req)
+		}
+
+		var head, tail []DataPoint
+		if from.Before(entry.from) {
+			if head, ok, err = querySlice(ctx, handler, target, req, from, entry.from); err != nil {
+				return nil, err
+			} else if !ok {
+				return c.queryAll(ctx, handler, key, target, req)
+			}
+		}
+		cachedTo := entry.to.Add(-c.overlap)
+		if cachedTo.Before(entry.from) {
+			// the overlap is longer than the cached time range: don't let the tail overlap the head.
+			cachedTo = entry.from
+		}
+		if cachedTo.Before(from) {
+			cachedTo = from
+		}
+		if cachedTo.After(to) {
+			// the cache covers the end of the requested time range, including the data point at to.
+			cachedTo = to.Add(time.Nanosecond)
+		} else {
+			if tail, ok, err = querySlice(ctx, handler, target, req, cachedTo, to); err != nil {
+				return nil, err
+			} else if !ok {
+				return c.queryAll(ctx, handler, key, target, req)
+			}
+		}
+
+		dataPoints := make([]DataPoint, 0, len(head)+len(entry.dataPoints)+len(tail))
+		dataPoints = appendDataPoints(dataPoints, head, from, entry.from)
+		dataPoints = appendDataPoints(dataPoints, entry.dataPoints, from, cachedTo)
+		dataPoints = appendDataPoints(dataPoints, tail, cachedTo, to.Add(time.Nanosecond))
+
+		entry = timeSeriesCacheEntry{target: entry.target, from: from, to: to, dataPoints: dataPoints}
+		c.cache.add(key, entry, len(dataPoints)*dataPointSize)
+		return TimeSeriesResponse{Target: entry.target, DataPoints: dataPoints}, nil
+	})
+}
+
+func (c *TimeSeriesCache) queryAll(ctx context.Context, handler Handler, key string, target string, req QueryRequest) (QueryResponse, error) {
+	resp, err := handler.Query(ctx, target, req)
+	if err != nil {
+		return nil, err
+	}
+	if timeSeries, ok := resp.(TimeSeriesResponse); ok {
+		c.cache.add(key, timeSeriesCacheEntry{
+			target:     timeSeries.Target,
+			from:       req.Range.From,
+			to:         req.Range.To,
+			dataPoints: timeSeries.DataPoints,
+		}, len(timeSeries.DataPoints)*dataPointSize)
+	}
+	return resp, nil
+}
+
+// querySlice calls the handler for the time range [from, to]. If the handler does not return a TimeSeriesResponse,
+// querySlice returns false.
+func querySlice(ctx context.Context, handler Handler, target string, req QueryRequest, from, to time.Time) ([]DataPoint, bool, error) {
+	req.Range.From = from
+	req.Range.To = to
+	resp, err := handler.Query(ctx, target, req)
+	if err != nil {
+		return nil, false, err
+	}
+	timeSeries, ok := resp.(TimeSeriesResponse)
+	return timeSeries.DataPoints, ok, nil
+}
+
+// appendDataPoints appends all data points in the time range [from, to) to dst.
+func appendDataPoints(dst []DataPoint, dataPoints []DataPoint, from, to time.Time) []DataPoint {
+	for _, dataPoint := range dataPoints {
+		if !dataPoint.Timestamp.Before(from) && dataPoint.Timestamp.Before(to) {
+			dst = append(dst, dataPoint)
+		}
+	}
+	return dst
+}
+
+func timeSeriesCacheKey(target string, req QueryRequest) (string, error) {
+	payload, _ := req.findPayload(target)
+	key, err := json.Marshal(struct {
+		Target       string
+		Payload      json.RawMessage
+		ScopedVars   json.RawMessage
+		AdhocFilters []any
+		IntervalMs   int
+	}{
+		Target:       target,
+		Payload:      payload,
+		ScopedVars:   req.ScopedVars,
+		AdhocFilters: req.AdhocFilters,
+		IntervalMs:   req.IntervalMs,
+	})
+	return string(key), err
+}
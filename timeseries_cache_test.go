@@ -0,0 +1,150 @@
+package grafana_json_server_test
+
+import (
+	"context"
+	"errors"
+	gjson "github.com/clambin/grafana-json-server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestTimeSeriesCache_Handler(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	type call struct{ from, to time.Time }
+	var calls []call
+	handler := gjson.HandlerFunc(func(_ context.Context, target string, req gjson.QueryRequest) (gjson.QueryResponse, error) {
+		calls = append(calls, call{from: req.Range.From, to: req.Range.To})
+		resp := gjson.TimeSeriesResponse{Target: target}
+		for ts := req.Range.From; !ts.After(req.Range.To); ts = ts.Add(time.Minute) {
+			resp.DataPoints = append(resp.DataPoints, gjson.DataPoint{Timestamp: ts, Value: float64(ts.Sub(start) / time.Minute)})
+		}
+		return resp, nil
+	})
+
+	h := gjson.NewTimeSeriesCache(gjson.TimeSeriesCacheOptions{TTL: time.Hour, Overlap: time.Minute}).Handler(handler)
+
+	tests := []struct {
+		name      string
+		from      time.Duration
+		to        time.Duration
+		wantCalls []call
+	}{
+		{
+			name:      "initial",
+			from:      0,
+			to:        10 * time.Minute,
+			wantCalls: []call{{from: start, to: start.Add(10 * time.Minute)}},
+		},
+		{
+			name:      "refresh",
+			from:      2 * time.Minute,
+			to:        12 * time.Minute,
+			wantCalls: []call{{from: start.Add(9 * time.Minute), to: start.Add(12 * time.Minute)}},
+		},
+		{
+			name: "extend",
+			from: 0,
+			to:   13 * time.Minute,
+			wantCalls: []call{
+				{from: start, to: start.Add(2 * time.Minute)},
+				{from: start.Add(11 * time.Minute), to: start.Add(13 * time.Minute)},
+			},
+		},
+		{
+			name:      "no overlap",
+			from:      time.Hour,
+			to:        time.Hour + 10*time.Minute,
+			wantCalls: []call{{from: start.Add(time.Hour), to: start.Add(time.Hour + 10*time.Minute)}},
+		},
+		{
+			name: "zoom in",
+			from: time.Hour + 2*time.Minute,
+			to:   time.Hour + 5*time.Minute,
+		},
+		{
+			name:      "shift back",
+			from:      time.Hour - time.Minute,
+			to:        time.Hour + 2*time.Minute,
+			wantCalls: []call{{from: start.Add(time.Hour - time.Minute), to: start.Add(time.Hour + 2*time.Minute)}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			req := gjson.QueryRequest{
+				Range:   gjson.Range{From: start.Add(tt.from), To: start.Add(tt.to)},
+				Targets: []gjson.QueryRequestTarget{{Target: "foo"}},
+			}
+			resp, err := h.Query(context.Background(), "foo", req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantCalls, calls)
+
+			want, _ := handler.Query(context.Background(), "foo", req)
+			assert.Equal(t, want, resp)
+		})
+	}
+}
+
+func TestTimeSeriesCache_Handler_LongOverlap(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC)
+	type call struct{ from, to time.Time }
+	var calls []call
+	handler := gjson.HandlerFunc(func(_ context.Context, target string, req gjson.QueryRequest) (gjson.QueryResponse, error) {
+		calls = append(calls, call{from: req.Range.From, to: req.Range.To})
+		resp := gjson.TimeSeriesResponse{Target: target}
+		for ts := req.Range.From; !ts.After(req.Range.To); ts = ts.Add(time.Minute) {
+			resp.DataPoints = append(resp.DataPoints, gjson.DataPoint{Timestamp: ts, Value: float64(ts.Sub(start) / time.Minute)})
+		}
+		return resp, nil
+	})
+
+	// the overlap is longer than the cached time range
+	h := gjson.NewTimeSeriesCache(gjson.TimeSeriesCacheOptions{TTL: time.Hour, Overlap: 5 * time.Minute}).Handler(handler)
+	query := func(from, to time.Time) gjson.QueryResponse {
+		resp, err := h.Query(context.Background(), "foo", gjson.QueryRequest{Range: gjson.Range{From: from, To: to}})
+		require.NoError(t, err)
+		return resp
+	}
+
+	_ = query(start, start.Add(time.Minute))
+	calls = nil
+
+	from, to := start.Add(-10*time.Minute), start.Add(5*time.Minute)
+	resp := query(from, to)
+	assert.Equal(t, []call{{from: from, to: start}, {from: start, to: to}}, calls)
+
+	want, _ := handler.Query(context.Background(), "foo", gjson.QueryRequest{Range: gjson.Range{From: from, To: to}})
+	assert.Equal(t, want, resp)
+}
+
+func TestTimeSeriesCache_Handler_Failures(t *testing.T) {
+	var fail bool
+	handler := gjson.HandlerFunc(func(_ context.Context, target string, req gjson.QueryRequest) (gjson.QueryResponse, error) {
+		if fail {
+			return nil, errors.New("failed")
+		}
+		if target == "table" {
+			return gjson.TableResponse{}, nil
+		}
+		return gjson.TimeSeriesResponse{Target: target, DataPoints: []gjson.DataPoint{{Timestamp: req.Range.To, Value: 1}}}, nil
+	})
+	h := gjson.NewTimeSeriesCache(gjson.TimeSeriesCacheOptions{TTL: time.Hour}).Handler(handler)
+
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	req := gjson.QueryRequest{Range: gjson.Range{From: start, To: start.Add(time.Hour)}}
+
+	resp, err := h.Query(context.Background(), "table", req)
+	require.NoError(t, err)
+	assert.Equal(t, gjson.TableResponse{}, resp)
+
+	_, err = h.Query(context.Background(), "foo", req)
+	require.NoError(t, err)
+
+	fail = true
+	req.Range.To = req.Range.To.Add(time.Minute)
+	_, err = h.Query(context.Background(), "foo", req)
+	assert.Error(t, err)
+}
@@ -1,24 +1,63 @@
 package grafana_json_server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
 )
 
+// A VariableHandler returns a list of possible values for a dashboard variable. Use WithVariableHandler to add a
+// VariableHandler to the server.
+type VariableHandler interface {
+	Variables(ctx context.Context, req VariableRequest) ([]Variable, error)
+}
+
+// The VariableHandlerFunc type is an adapter to allow the use of an ordinary function as a VariableHandler.
+// If f is a function with the appropriate signature, then VariableHandlerFunc(f) is a VariableHandler that calls f.
+type VariableHandlerFunc func(ctx context.Context, req VariableRequest) ([]Variable, error)
+
+// Variables calls f(ctx, req)
+func (f VariableHandlerFunc) Variables(ctx context.Context, req VariableRequest) ([]Variable, error) {
+	return f(ctx, req)
+}
+
 // VariableFunc is the function signature of function provided to WithVariable.
 // It returns a list of possible values for a dashboard variable.
+//
+// Unlike a VariableHandler, a VariableFunc does not receive the request's context. VariableFunc implements
+// VariableHandler, by ignoring the context.
 type VariableFunc func(VariableRequest) ([]Variable, error)
 
-// VariableRequest is the request sent to VariableFunc.
+// Variables calls f(req)
+func (f VariableFunc) Variables(_ context.Context, req VariableRequest) ([]Variable, error) {
+	return f(req)
+}
+
+// VariableRequest is the request sent to a VariableHandler.
 //
 // Payload and Target are determined by the Grafana definition of the variable:
 //   - if Raw JSON is off, Payload contains a JSON object with a single field "target", as set in the Variable's Query field.
 //   - if Raw JSON is on, Payload contains the JSON object set in the Variable's Query field.
 //
 // In both cases, if the Payload contains a field "target", its value is stored in Target. If no "target" exists, Target is blank. No error is raised.
+//
+// Grafana interpolates any dashboard variables in the Payload, so a variable can depend on the values selected for other
+// variables. E.g. a "host" variable with the Raw JSON query { "target": "hosts", "cluster": ${cluster:json} } receives
+// the selected cluster(s) in its payload. Use GetPayload to read them.
 type VariableRequest struct {
-	Payload json.RawMessage `json:"payload"`
-	Range   Range           `json:"range"`
-	Target  string
+	Payload    json.RawMessage `json:"payload"`
+	Range      Range           `json:"range"`
+	ScopedVars json.RawMessage `json:"scopedVars"`
+	Target     string
+	// Matches holds the text matched by each capture group of the pattern that routed the request to the VariableHandler.
+	// See WithVariablePattern and WithVariableRegexp. For requests routed by name, Matches is nil.
+	Matches []string `json:"-"`
+	// Route is the name or pattern by which the server routed the request to the VariableHandler: the registered name,
+	// the pattern passed to WithVariablePattern or WithVariableRegexp, or "default" for the default handler.
+	// Unlike Target, Route only holds values registered with the server, so it is safe to use as a Prometheus label.
+	Route string `json:"-"`
 }
 
 func (v *VariableRequest) UnmarshalJSON(bytes []byte) error {
@@ -38,6 +77,52 @@ func (v *VariableRequest) UnmarshalJSON(bytes []byte) error {
 	return err
 }
 
+// GetPayload unmarshals the request's payload, i.e. the variable's query with all dashboard variables interpolated,
+// into the provided payload.
+func (v VariableRequest) GetPayload(payload any) error {
+	if len(v.Payload) == 0 {
+		return errors.New("no payload found")
+	}
+	return json.Unmarshal(v.Payload, payload)
+}
+
+// GetScopedVars unmarshals the scoped variables sent with the request into a Go structure, in the same way as
+// QueryRequest.GetScopedVars. Not all versions of Grafana send scoped variables with a variable request. If the request
+// has no scoped variables, vars is left unchanged.
+func (v VariableRequest) GetScopedVars(vars any) error {
+	if len(v.ScopedVars) == 0 {
+		return nil
+	}
+	return json.Unmarshal(v.ScopedVars, vars)
+}
+
+// variablePattern routes variable requests whose target matches the regular expression to a VariableHandler.
+// The pattern, as registered, is used to label the requests in the server's Prometheus metrics.
+type variablePattern struct {
+	pattern string
+	re      *regexp.Regexp
+	handler VariableHandler
+}
+
+// globToRegexp converts a glob pattern to an anchored regular expression, with a capture group for each wildcard:
+// "*" matches any sequence of characters and "?" matches any single character.
+func globToRegexp(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString("(.*)")
+		case '?':
+			expr.WriteString("(.)")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
+
 // Variable is one possible value for a dashboard value.
 // Text is the name to be displayed on the screen. Value will be used in API calls.
 type Variable struct {
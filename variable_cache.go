@@ -0,0 +1,129 @@
+package grafana_json_server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// VariableCacheOptions configures a VariableCache.
+type VariableCacheOptions struct {
+	// TTL is how long a list of variable values remains in the cache.
+	TTL time.Duration
+	// MaxSize is the maximum size of all cached variable values, in bytes. The size of a list of values is the size of its JSON encoding.
+	// When the cache is full, the least recently used values are removed. If MaxSize is zero, the cache size is not limited:
+	// expired values are still removed as new values are added.
+	MaxSize int
+	// Granularity determines how the request's time range is used in the cache key. If Granularity is zero, the time range
+	// is ignored, and all requests for the same target and payload share the same values. Otherwise, the time range is
+	// aligned to Granularity, so requests whose time range falls in the same interval share the same values.
+	//
+	// Set Granularity for variables that are refreshed on time range change and whose values depend on the time range.
+	Granularity time.Duration
+	// Namespace and Subsystem are prepended to the name of the cache's Prometheus metrics, if not blank.
+	Namespace string
+	Subsystem string
+	// Application is added to the cache's Prometheus metrics as a label "application".
+	Application string
+}
+
+// A VariableCache caches the values returned by one or more VariableHandlers. Use its Handler method to add caching to a VariableHandler:
+//
+//	cache := grafanaJSONServer.NewVariableCache(grafanaJSONServer.VariableCacheOptions{TTL: 5 * time.Minute})
+//	s := grafanaJSONServer.NewServer(
+//		grafanaJSONServer.WithVariableHandler("hosts", cache.Handler(handler)),
+//	)
+//
+// Values are cached per target, payload and scoped variables and, if VariableCacheOptions.Granularity is set, time range.
+//
+// VariableCache implements prometheus.Collector, counting cache hits and misses per variable. Requests are labelled
+// by their Route, rather than their Target, so variables served by a pattern don't create a time series per target.
+// The caller must register the cache with the Prometheus registry.
+type VariableCache struct {
+	cache       *lruCache[[]Variable]
+	granularity time.Duration
+	hits        *prometheus.CounterVec
+	misses      *prometheus.CounterVec
+}
+
+var _ prometheus.Collector = &VariableCache{}
+
+// NewVariableCache returns a new VariableCache, configured as per the provided VariableCacheOptions.
+func NewVariableCache(options VariableCacheOptions) *VariableCache {
+	return &VariableCache{
+		cache:       newLRUCache[[]Variable](options.TTL, options.MaxSize),
+		granularity: options.Granularity,
+		hits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   options.Namespace,
+			Subsystem:   options.Subsystem,
+			Name:        "json_variable_cache_hit_count",
+			Help:        "Grafana JSON Data server count of variable values served from cache",
+			ConstLabels: prometheus.Labels{"application": options.Application},
+		}, []string{"target"}),
+		misses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   options.Namespace,
+			Subsystem:   options.Subsystem,
+			Name:        "json_variable_cache_miss_count",
+			Help:        "Grafana JSON Data server count of variable values not found in cache",
+			ConstLabels: prometheus.Labels{"application": options.Application},
+		}, []string{"target"}),
+	}
+}
+
+// Handler returns a VariableHandler that serves values from the cache and calls handler for any values not found in the cache.
+// Failed requests are not cached.
+func (c *VariableCache) Handler(handler VariableHandler) VariableHandler {
+	return VariableHandlerFunc(func(ctx context.Context, req VariableRequest) ([]Variable, error) {
+		key, err := c.key(req)
+		if err != nil {
+			return handler.Variables(ctx, req)
+		}
+		if variables, ok := c.cache.get(key); ok {
+			c.hits.WithLabelValues(req.Route).Add(1)
+			return variables, nil
+		}
+		c.misses.WithLabelValues(req.Route).Add(1)
+		variables, err := handler.Variables(ctx, req)
+		if err == nil {
+			// use the size of the JSON encoding as an estimate of the values' memory size.
+			if body, err2 := json.Marshal(variables); err2 == nil {
+				c.cache.add(key, variables, len(body))
+			}
+		}
+		return variables, err
+	})
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *VariableCache) Describe(descs chan<- *prometheus.Desc) {
+	c.hits.Describe(descs)
+	c.misses.Describe(descs)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *VariableCache) Collect(metrics chan<- prometheus.Metric) {
+	c.hits.Collect(metrics)
+	c.misses.Collect(metrics)
+}
+
+func (c *VariableCache) key(req VariableRequest) (string, error) {
+	var from, to time.Time
+	if c.granularity > 0 {
+		from, to = req.Range.From.Truncate(c.granularity), req.Range.To.Truncate(c.granularity)
+	}
+	key, err := json.Marshal(struct {
+		Target     string
+		Payload    json.RawMessage
+		ScopedVars json.RawMessage
+		From       time.Time
+		To         time.Time
+	}{
+		Target:     req.Target,
+		Payload:    req.Payload,
+		ScopedVars: req.ScopedVars,
+		From:       from,
+		To:         to,
+	})
+	return string(key), err
+}
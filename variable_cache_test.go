@@ -0,0 +1,150 @@
+package grafana_json_server_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	gjson "github.com/clambin/grafana-json-server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVariableCache_Handler(t *testing.T) {
+	var calls int
+	handler := gjson.VariableHandlerFunc(func(_ context.Context, req gjson.VariableRequest) ([]gjson.Variable, error) {
+		calls++
+		if req.Target == "fail" {
+			return nil, errors.New("failed")
+		}
+		return []gjson.Variable{{Text: req.Target, Value: strconv.Itoa(calls)}}, nil
+	})
+
+	cache := gjson.NewVariableCache(gjson.VariableCacheOptions{TTL: time.Hour, Application: "test"})
+	h := cache.Handler(handler)
+
+	tests := []struct {
+		name      string
+		target    string
+		payload   string
+		offset    time.Duration
+		wantErr   assert.ErrorAssertionFunc
+		wantValue string
+	}{
+		{name: "miss", target: "foo", payload: `{"target":"foo","a":"b"}`, wantErr: assert.NoError, wantValue: "1"},
+		{name: "hit", target: "foo", payload: `{"target":"foo","a":"b"}`, wantErr: assert.NoError, wantValue: "1"},
+		{name: "hit - time range is ignored", target: "foo", payload: `{"target":"foo","a":"b"}`, offset: time.Hour, wantErr: assert.NoError, wantValue: "1"},
+		{name: "miss - different payload", target: "foo", payload: `{"target":"foo","a":"c"}`, wantErr: assert.NoError, wantValue: "2"},
+		{name: "miss - different target", target: "bar", payload: `{"target":"bar","a":"b"}`, wantErr: assert.NoError, wantValue: "3"},
+		{name: "error", target: "fail", payload: `{"target":"fail"}`, wantErr: assert.Error},
+		{name: "error not cached", target: "fail", payload: `{"target":"fail"}`, wantErr: assert.Error},
+	}
+
+	from := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			variables, err := h.Variables(context.Background(), gjson.VariableRequest{
+				Payload: json.RawMessage(tt.payload),
+				Range:   gjson.Range{From: from.Add(tt.offset), To: from.Add(time.Hour + tt.offset)},
+				Target:  tt.target,
+				Route:   tt.target,
+			})
+			tt.wantErr(t, err)
+			if err == nil {
+				require.Len(t, variables, 1)
+				assert.Equal(t, tt.wantValue, variables[0].Value)
+			}
+		})
+	}
+
+	assert.Equal(t, 5, calls)
+	assert.NoError(t, testutil.CollectAndCompare(cache, strings.NewReader(`
+# HELP json_variable_cache_hit_count Grafana JSON Data server count of variable values served from cache
+# TYPE json_variable_cache_hit_count counter
+json_variable_cache_hit_count{application="test",target="foo"} 2
+# HELP json_variable_cache_miss_count Grafana JSON Data server count of variable values not found in cache
+# TYPE json_variable_cache_miss_count counter
+json_variable_cache_miss_count{application="test",target="bar"} 1
+json_variable_cache_miss_count{application="test",target="fail"} 2
+json_variable_cache_miss_count{application="test",target="foo"} 2
+`)))
+}
+
+func TestVariableCache_Route(t *testing.T) {
+	cache := gjson.NewVariableCache(gjson.VariableCacheOptions{TTL: time.Hour, Application: "test"})
+	s := gjson.NewServer(
+		gjson.WithVariablePattern("tags(*)", cache.Handler(gjson.VariableHandlerFunc(func(_ context.Context, req gjson.VariableRequest) ([]gjson.Variable, error) {
+			return []gjson.Variable{{Text: req.Matches[0], Value: req.Matches[0]}}, nil
+		}))),
+	)
+
+	for _, target := range []string{"tags(service)", "tags(host)", "tags(service)"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost/variable", strings.NewReader(`{ "payload": { "target": "`+target+`" } }`))
+		s.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// variables served by a pattern are labelled by the pattern, not by their target
+	assert.NoError(t, testutil.CollectAndCompare(cache, strings.NewReader(`
+# HELP json_variable_cache_hit_count Grafana JSON Data server count of variable values served from cache
+# TYPE json_variable_cache_hit_count counter
+json_variable_cache_hit_count{application="test",target="tags(*)"} 1
+# HELP json_variable_cache_miss_count Grafana JSON Data server count of variable values not found in cache
+# TYPE json_variable_cache_miss_count counter
+json_variable_cache_miss_count{application="test",target="tags(*)"} 2
+`)))
+}
+
+func TestVariableCache_Granularity(t *testing.T) {
+	var calls int
+	handler := gjson.VariableHandlerFunc(func(_ context.Context, _ gjson.VariableRequest) ([]gjson.Variable, error) {
+		calls++
+		return []gjson.Variable{{Text: "foo", Value: "foo"}}, nil
+	})
+
+	h := gjson.NewVariableCache(gjson.VariableCacheOptions{TTL: time.Hour, Granularity: time.Hour}).Handler(handler)
+	from := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	query := func(offset time.Duration) {
+		_, err := h.Variables(context.Background(), gjson.VariableRequest{
+			Payload: json.RawMessage(`{"target":"foo"}`),
+			Range:   gjson.Range{From: from.Add(offset), To: from.Add(24*time.Hour + offset)},
+			Target:  "foo",
+		})
+		require.NoError(t, err)
+	}
+
+	query(0)
+	query(30 * time.Minute)
+	assert.Equal(t, 1, calls)
+	query(time.Hour)
+	assert.Equal(t, 2, calls)
+}
+
+func TestVariableCache_Expiry(t *testing.T) {
+	var calls int
+	handler := gjson.VariableHandlerFunc(func(_ context.Context, _ gjson.VariableRequest) ([]gjson.Variable, error) {
+		calls++
+		return []gjson.Variable{{Text: "foo", Value: "foo"}}, nil
+	})
+
+	h := gjson.NewVariableCache(gjson.VariableCacheOptions{TTL: 50 * time.Millisecond}).Handler(handler)
+	req := gjson.VariableRequest{Payload: json.RawMessage(`{"target":"foo"}`), Target: "foo"}
+
+	for range 2 {
+		_, err := h.Variables(context.Background(), req)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, calls)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err := h.Variables(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
@@ -1,9 +1,15 @@
 package grafana_json_server_test
 
 import (
+	"context"
 	"encoding/json"
 	gjson "github.com/clambin/grafana-json-server"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -73,3 +79,164 @@ func TestVariableRequest_UnmarshalJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestVariableRequest_GetPayload(t *testing.T) {
+	var payload struct {
+		Cluster string `json:"cluster"`
+	}
+	req := gjson.VariableRequest{Payload: json.RawMessage(`{ "target": "hosts", "cluster": "prod" }`)}
+	assert.NoError(t, req.GetPayload(&payload))
+	assert.Equal(t, "prod", payload.Cluster)
+
+	assert.Error(t, gjson.VariableRequest{}.GetPayload(&payload))
+}
+
+func TestVariableRequest_GetScopedVars(t *testing.T) {
+	var req gjson.VariableRequest
+	require.NoError(t, json.Unmarshal([]byte(`{ "payload": { "target": "hosts" }, "scopedVars": { "cluster": { "text": "Production", "value": "prod" } } }`), &req))
+
+	var scopedVars struct {
+		Cluster gjson.ScopedVar[string]
+	}
+	assert.NoError(t, req.GetScopedVars(&scopedVars))
+	assert.Equal(t, gjson.ScopedVar[string]{Text: "Production", Value: "prod"}, scopedVars.Cluster)
+
+	// no scoped vars
+	scopedVars.Cluster = gjson.ScopedVar[string]{}
+	assert.NoError(t, gjson.VariableRequest{}.GetScopedVars(&scopedVars))
+	assert.Zero(t, scopedVars.Cluster)
+}
+
+func TestServer_ChainedVariables(t *testing.T) {
+	s := gjson.NewServer(
+		gjson.WithVariableHandler("clusters", gjson.VariableHandlerFunc(clusterVariables)),
+		gjson.WithVariableHandler("hosts", gjson.VariableHandlerFunc(hostVariables)),
+		gjson.WithVariableHandler("disks", gjson.VariableHandlerFunc(diskVariables)),
+	)
+
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{
+			name:    "clusters",
+			payload: `{ "target": "clusters" }`,
+			want:    `[{"__text":"prod","__value":"prod"},{"__text":"test","__value":"test"}]`,
+		},
+		{
+			name:    "hosts",
+			payload: `{ "target": "hosts", "clusters": ["prod"] }`,
+			want:    `[{"__text":"prod-1","__value":"prod-1"},{"__text":"prod-2","__value":"prod-2"}]`,
+		},
+		{
+			name:    "hosts - multiple clusters",
+			payload: `{ "target": "hosts", "clusters": ["prod","test"] }`,
+			want:    `[{"__text":"prod-1","__value":"prod-1"},{"__text":"prod-2","__value":"prod-2"},{"__text":"test-1","__value":"test-1"}]`,
+		},
+		{
+			name:    "disks",
+			payload: `{ "target": "disks", "clusters": ["prod"], "hosts": ["prod-1"] }`,
+			want:    `[{"__text":"prod-1:sda","__value":"prod-1:sda"},{"__text":"prod-1:sdb","__value":"prod-1:sdb"}]`,
+		},
+		{
+			name:    "disks - no hosts selected",
+			payload: `{ "target": "disks", "clusters": ["prod"], "hosts": [] }`,
+			want:    `null`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "http://localhost/variable", strings.NewReader(`{ "payload": `+tt.payload+` }`))
+			s.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.want+"\n", w.Body.String())
+		})
+	}
+}
+
+func TestServer_VariablePatterns(t *testing.T) {
+	echo := func(prefix string) gjson.VariableHandlerFunc {
+		return func(_ context.Context, req gjson.VariableRequest) ([]gjson.Variable, error) {
+			variables := []gjson.Variable{{Text: prefix, Value: prefix}}
+			for _, match := range req.Matches {
+				variables = append(variables, gjson.Variable{Text: match, Value: match})
+			}
+			return variables, nil
+		}
+	}
+
+	tests := []struct {
+		name     string
+		options  []gjson.Option
+		target   string
+		wantCode int
+		want     string
+	}{
+		{
+			name:     "exact name takes precedence",
+			options:  []gjson.Option{gjson.WithVariableHandler("hosts/prod", echo("exact")), gjson.WithVariablePattern("hosts/*", echo("glob"))},
+			target:   "hosts/prod",
+			wantCode: http.StatusOK,
+			want:     `[{"__text":"exact","__value":"exact"}]`,
+		},
+		{
+			name:     "glob",
+			options:  []gjson.Option{gjson.WithVariableHandler("hosts", echo("exact")), gjson.WithVariablePattern("hosts/*", echo("glob"))},
+			target:   "hosts/prod",
+			wantCode: http.StatusOK,
+			want:     `[{"__text":"glob","__value":"glob"},{"__text":"prod","__value":"prod"}]`,
+		},
+		{
+			name:     "glob - special characters are literal",
+			options:  []gjson.Option{gjson.WithVariablePattern("metrics(?.*)", echo("glob"))},
+			target:   "metrics(a.cpu)",
+			wantCode: http.StatusOK,
+			want:     `[{"__text":"glob","__value":"glob"},{"__text":"a","__value":"a"},{"__text":"cpu","__value":"cpu"}]`,
+		},
+		{
+			name:     "glob - no match",
+			options:  []gjson.Option{gjson.WithVariablePattern("hosts/*", echo("glob"))},
+			target:   "disks/prod",
+			wantCode: http.StatusBadRequest,
+			want:     `no variable handler found for 'disks/prod'`,
+		},
+		{
+			name:     "regexp",
+			options:  []gjson.Option{gjson.WithVariableRegexp(regexp.MustCompile(`^tags\((\w+)\)$`), echo("regexp"))},
+			target:   "tags(service)",
+			wantCode: http.StatusOK,
+			want:     `[{"__text":"regexp","__value":"regexp"},{"__text":"service","__value":"service"}]`,
+		},
+		{
+			name: "first matching pattern wins",
+			options: []gjson.Option{
+				gjson.WithVariableRegexp(regexp.MustCompile(`^tags\((\w+)\)$`), echo("first")),
+				gjson.WithVariablePattern("tags(*)", echo("second")),
+			},
+			target:   "tags(service)",
+			wantCode: http.StatusOK,
+			want:     `[{"__text":"first","__value":"first"},{"__text":"service","__value":"service"}]`,
+		},
+		{
+			name:     "default",
+			options:  []gjson.Option{gjson.WithVariablePattern("hosts/*", echo("glob")), gjson.WithDefaultVariableHandler(echo("default"))},
+			target:   "disks/prod",
+			wantCode: http.StatusOK,
+			want:     `[{"__text":"default","__value":"default"}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := gjson.NewServer(tt.options...)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "http://localhost/variable", strings.NewReader(`{ "payload": { "target": "`+tt.target+`" } }`))
+			s.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Equal(t, tt.want+"\n", w.Body.String())
+		})
+	}
+}